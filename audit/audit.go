@@ -0,0 +1,110 @@
+// Package audit records who changed which document or user, when, and with
+// what patch, in the audit_log table.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+)
+
+// Resource types.
+const (
+	Document = "document"
+	User     = "user"
+)
+
+// Operation kinds.
+const (
+	Create  = "create"
+	Replace = "replace"
+	Patch   = "patch"
+	Revert  = "revert"
+	Delete  = "delete"
+	// PasswordChange and PasswordReset are recorded without a patch.
+	PasswordChange = "password-change"
+	PasswordReset  = "password-reset"
+)
+
+// Request identifies the request a change was made by.
+type Request struct {
+	// Actor is who made the request, or "" when it was not authenticated.
+	Actor     string
+	RequestID string
+}
+
+// FromRequest returns the actor and request id of req. The actor comes
+// from the API Gateway authorizer context or the caller's identity. The
+// request id is API Gateway's, Netlify's X-Nf-Request-Id or the client's
+// X-Request-Id, and is generated when none of those are set, so entries
+// written by one request can still be grouped.
+func FromRequest(req events.APIGatewayProxyRequest) Request {
+	return Request{
+		Actor:     actor(req),
+		RequestID: requestID(req),
+	}
+}
+
+func actor(req events.APIGatewayProxyRequest) string {
+	if principal, ok := req.RequestContext.Authorizer["principalId"].(string); ok && principal != "" {
+		return principal
+	}
+	if claims, ok := req.RequestContext.Authorizer["claims"].(map[string]interface{}); ok {
+		if sub, ok := claims["sub"].(string); ok && sub != "" {
+			return sub
+		}
+	}
+	return req.RequestContext.Identity.User
+}
+
+func requestID(req events.APIGatewayProxyRequest) string {
+	if req.RequestContext.RequestID != "" {
+		return req.RequestContext.RequestID
+	}
+	for name, value := range req.Headers {
+		switch strings.ToLower(name) {
+		case "x-nf-request-id", "x-request-id":
+			if value != "" {
+				return value
+			}
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type requestKey struct{}
+
+// WithRequest returns a context carrying r, for Record to find.
+func WithRequest(ctx context.Context, r Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+// RequestFrom returns the Request stored in ctx by WithRequest.
+func RequestFrom(ctx context.Context) Request {
+	r, _ := ctx.Value(requestKey{}).(Request)
+	return r
+}
+
+// Record writes an audit entry for an operation on a resource by the
+// request in ctx. patch is the JSON Patch that was applied, if any. Pass
+// queries bound to the transaction making the change, so the entry commits
+// or rolls back with it.
+func Record(ctx context.Context, q *data.Queries, resourceType string, resourceID int64, operation string, patch json.RawMessage) error {
+	r := RequestFrom(ctx)
+	return q.CreateAuditEntry(ctx, data.CreateAuditEntryParams{
+		Actor:        sql.NullString{String: r.Actor, Valid: r.Actor != ""},
+		RequestID:    r.RequestID,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Operation:    operation,
+		Patch:        sql.NullString{String: string(patch), Valid: len(patch) > 0},
+	})
+}
@@ -0,0 +1,30 @@
+package audit
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestFromRequest(t *testing.T) {
+	req := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"x-nf-request-id": "01ABC"},
+	}
+	req.RequestContext.Authorizer = map[string]interface{}{
+		"claims": map[string]interface{}{"sub": "user-7"},
+	}
+	if r := FromRequest(req); r.Actor != "user-7" || r.RequestID != "01ABC" {
+		t.Errorf("got %+v", r)
+	}
+
+	req.RequestContext.RequestID = "gw-1"
+	req.RequestContext.Authorizer["principalId"] = "svc"
+	if r := FromRequest(req); r.Actor != "svc" || r.RequestID != "gw-1" {
+		t.Errorf("API Gateway values should win, got %+v", r)
+	}
+
+	anonymous := FromRequest(events.APIGatewayProxyRequest{})
+	if anonymous.Actor != "" || len(anonymous.RequestID) != 32 {
+		t.Errorf("expected no actor and a generated request id, got %+v", anonymous)
+	}
+}
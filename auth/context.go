@@ -0,0 +1,18 @@
+package auth
+
+import "context"
+
+type claimsKey struct{}
+
+// WithClaims returns a context carrying the claims of an authenticated
+// request.
+func WithClaims(ctx context.Context, c Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, c)
+}
+
+// ClaimsFrom returns the claims stored by WithClaims, and false for an
+// anonymous request.
+func ClaimsFrom(ctx context.Context) (Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(Claims)
+	return c, ok
+}
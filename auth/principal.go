@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+)
+
+// ErrUnknownUser is returned by Load when a valid token names a user that
+// has since been deleted.
+var ErrUnknownUser = errors.New("auth: user no longer exists")
+
+// ErrForbidden is returned by Authorize when the user's roles do not allow
+// the permission asked for.
+var ErrForbidden = errors.New("auth: permission denied")
+
+// Load authenticates req and looks up the current roles of the user its
+// token was issued to, returning a context carrying the claims and the
+// Principal. Roles are read on every request rather than from the token,
+// so role changes apply immediately. It returns ErrNoToken for anonymous
+// requests, and ErrInvalidToken, ErrExpiredToken or ErrUnknownUser for
+// tokens that cannot be accepted.
+func Load(ctx context.Context, q *data.Queries, req events.APIGatewayProxyRequest) (context.Context, error) {
+	claims, err := Authenticate(req)
+	if err != nil {
+		return ctx, err
+	}
+	ctx = WithClaims(ctx, claims)
+
+	userID, err := claims.UserID()
+	if err != nil {
+		return ctx, err
+	}
+	user, err := q.GetUser(ctx, userID)
+	if err == sql.ErrNoRows {
+		return ctx, ErrUnknownUser
+	}
+	if err != nil {
+		return ctx, err
+	}
+	roles, err := q.ListUserRoles(ctx, user.ID)
+	if err != nil {
+		return ctx, err
+	}
+	return WithPrincipal(ctx, &Principal{UserID: user.ID, Roles: roles}), nil
+}
+
+// Rejected reports whether err from Load means the request's token was
+// refused, as opposed to missing or a failed lookup.
+func Rejected(err error) bool {
+	return errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrExpiredToken) ||
+		errors.Is(err, ErrUnknownUser) || errors.Is(err, ErrNoSecret)
+}
+
+// Authorize loads the principal of req like Load and checks that it holds a
+// role allowing perm. It returns the HTTP status for the outcome with the
+// error behind it: 401 for anonymous requests and rejected tokens, 403 with
+// ErrForbidden when the roles do not allow perm, 500 when the lookup failed,
+// and 200 with a nil error when the request may proceed.
+func Authorize(ctx context.Context, q *data.Queries, req events.APIGatewayProxyRequest, perm Permission) (context.Context, int, error) {
+	ctx, err := Load(ctx, q, req)
+	switch {
+	case errors.Is(err, ErrNoToken) || Rejected(err):
+		return ctx, http.StatusUnauthorized, err
+	case err != nil:
+		return ctx, http.StatusInternalServerError, err
+	case !PrincipalFrom(ctx).Can(perm):
+		return ctx, http.StatusForbidden, ErrForbidden
+	}
+	return ctx, http.StatusOK, nil
+}
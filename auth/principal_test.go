@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestAuthorizeRefusesBeforeLookup(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	secret := []byte("test-secret")
+	now := time.Now()
+	expired, err := NewAccessToken(secret, 1, "", now.Add(-2*AccessTokenTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noUser, err := Sign(secret, Claims{Subject: "me", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   error
+	}{
+		{"anonymous", "", ErrNoToken},
+		{"malformed", "Bearer abc", ErrInvalidToken},
+		{"expired", "Bearer " + expired, ErrExpiredToken},
+		{"subject is not a user id", "Bearer " + noUser, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		req := events.APIGatewayProxyRequest{Headers: map[string]string{}}
+		if tt.header != "" {
+			req.Headers["Authorization"] = tt.header
+		}
+		// None of these reach the database, so no queries are needed.
+		_, status, err := Authorize(context.Background(), nil, req, ReadDocuments)
+		if status != http.StatusUnauthorized || !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %d, %v; want 401, %v", tt.name, status, err, tt.want)
+		}
+	}
+}
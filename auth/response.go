@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DenyResponse is the response for a request Authorize refused with status
+// and err: a 401 with a Bearer challenge, a 403 naming perm, or a 500 for a
+// failed lookup, which is logged.
+func DenyResponse(status int, err error, perm Permission) events.APIGatewayProxyResponse {
+	switch {
+	case errors.Is(err, ErrNoToken):
+		return UnauthorizedResponse("Authentication required", "")
+	case status == http.StatusUnauthorized:
+		return UnauthorizedResponse("Invalid or expired access token", "invalid_token")
+	case status == http.StatusForbidden:
+		return errorResponse(http.StatusForbidden, "Your roles do not allow "+string(perm))
+	default:
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Failed to authenticate request")
+	}
+}
+
+// UnauthorizedResponse is a 401 with a Bearer challenge, carrying errorCode
+// when the request presented a token that was rejected.
+func UnauthorizedResponse(message, errorCode string) events.APIGatewayProxyResponse {
+	resp := errorResponse(http.StatusUnauthorized, message)
+	challenge := "Bearer"
+	if errorCode != "" {
+		challenge += ` error="` + errorCode + `"`
+	}
+	resp.Headers["WWW-Authenticate"] = challenge
+	return resp
+}
+
+func errorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
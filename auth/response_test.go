@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDenyResponse(t *testing.T) {
+	cases := []struct {
+		status    int
+		err       error
+		want      int
+		challenge string
+		body      string
+	}{
+		{http.StatusUnauthorized, ErrNoToken, http.StatusUnauthorized, "Bearer", `{"error":"Authentication required"}`},
+		{http.StatusUnauthorized, ErrExpiredToken, http.StatusUnauthorized, `Bearer error="invalid_token"`, `{"error":"Invalid or expired access token"}`},
+		{http.StatusUnauthorized, ErrUnknownUser, http.StatusUnauthorized, `Bearer error="invalid_token"`, `{"error":"Invalid or expired access token"}`},
+		{http.StatusForbidden, ErrForbidden, http.StatusForbidden, "", `{"error":"Your roles do not allow audit:read"}`},
+		{http.StatusInternalServerError, errors.New("database is locked"), http.StatusInternalServerError, "", `{"error":"Failed to authenticate request"}`},
+	}
+	for _, c := range cases {
+		resp := DenyResponse(c.status, c.err, ReadAuditLog)
+		if resp.StatusCode != c.want || resp.Headers["WWW-Authenticate"] != c.challenge || resp.Body != c.body {
+			t.Errorf("DenyResponse(%d, %v) = %d %q %s, want %d %q %s",
+				c.status, c.err, resp.StatusCode, resp.Headers["WWW-Authenticate"], resp.Body, c.want, c.challenge, c.body)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+// Roles a user can hold, assigned in the user_roles table.
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Permission is an operation a role may be allowed.
+type Permission string
+
+const (
+	ReadDocuments  Permission = "documents:read"
+	WriteDocuments Permission = "documents:write"
+	ReadUsers      Permission = "users:read"
+	// WriteUsers allows editing and deleting any user. Users may always
+	// edit their own profile.
+	WriteUsers Permission = "users:write"
+	// ManageRoles allows changing which roles a user holds.
+	ManageRoles    Permission = "roles:write"
+	ReadAuditLog   Permission = "audit:read"
+	ManageWebhooks Permission = "webhooks:write"
+)
+
+// rolePermissions maps each role to what it allows. Roles not listed here
+// allow nothing.
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		ReadDocuments, WriteDocuments,
+		ReadUsers, WriteUsers, ManageRoles,
+		ReadAuditLog, ManageWebhooks,
+	},
+	RoleEditor: {ReadDocuments, WriteDocuments, ReadUsers},
+	RoleViewer: {ReadDocuments, ReadUsers},
+}
+
+// ParseRoles splits a list of role names such as "admin, editor" into
+// role names. Roles are separated by commas or whitespace and compared
+// case-insensitively.
+func ParseRoles(s string) []string {
+	return NormalizeRoles(strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}))
+}
+
+// NormalizeRoles lowercases and trims role names, dropping empty names and
+// repeats of earlier ones.
+func NormalizeRoles(names []string) []string {
+	roles := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		roles = append(roles, name)
+	}
+	return roles
+}
+
+// Principal is the authenticated user a request acts as.
+type Principal struct {
+	UserID int64
+	Roles  []string
+}
+
+// Can reports whether any of the principal's roles allows p. A nil
+// Principal, an anonymous request, can do nothing.
+func (pr *Principal) Can(p Permission) bool {
+	if pr == nil {
+		return false
+	}
+	for _, role := range pr.Roles {
+		for _, allowed := range rolePermissions[role] {
+			if allowed == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Is reports whether the principal is the user with the given id.
+func (pr *Principal) Is(userID int64) bool {
+	return pr != nil && pr.UserID == userID
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the request's principal.
+func WithPrincipal(ctx context.Context, pr *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, pr)
+}
+
+// PrincipalFrom returns the principal stored by WithPrincipal, or nil for
+// an anonymous request.
+func PrincipalFrom(ctx context.Context) *Principal {
+	pr, _ := ctx.Value(principalKey{}).(*Principal)
+	return pr
+}
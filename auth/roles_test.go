@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoles(t *testing.T) {
+	if got := ParseRoles("Admin, editor  viewer"); !reflect.DeepEqual(got, []string{"admin", "editor", "viewer"}) {
+		t.Errorf("got %q", got)
+	}
+	if got := ParseRoles(""); len(got) != 0 {
+		t.Errorf("got %q for no roles", got)
+	}
+}
+
+func TestNormalizeRoles(t *testing.T) {
+	got := NormalizeRoles([]string{" Editor", "", "admin", "editor", "ADMIN"})
+	if want := []string{"editor", "admin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCan(t *testing.T) {
+	cases := []struct {
+		roles string
+		perm  Permission
+		want  bool
+	}{
+		{"admin", ManageRoles, true},
+		{"editor", WriteDocuments, true},
+		{"editor", ManageRoles, false},
+		{"viewer", ReadDocuments, true},
+		{"viewer", WriteDocuments, false},
+		{"viewer,editor", WriteDocuments, true},
+		{"superuser", ReadDocuments, false},
+	}
+	for _, c := range cases {
+		pr := &Principal{UserID: 1, Roles: ParseRoles(c.roles)}
+		if got := pr.Can(c.perm); got != c.want {
+			t.Errorf("%q can %s = %v, want %v", c.roles, c.perm, got, c.want)
+		}
+	}
+
+	var anonymous *Principal
+	if anonymous.Can(ReadDocuments) || anonymous.Is(0) {
+		t.Error("an anonymous principal should be allowed nothing")
+	}
+}
@@ -0,0 +1,170 @@
+// Package auth issues and verifies the access tokens the functions accept:
+// HS256 JSON Web Tokens signed with the secret in JWT_SECRET, plus opaque
+// refresh tokens that are stored hashed.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Token lifetimes.
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrNoToken is returned by Authenticate when the request carries no
+	// bearer token.
+	ErrNoToken = errors.New("auth: no bearer token")
+	// ErrInvalidToken is returned for malformed tokens and bad signatures.
+	ErrInvalidToken = errors.New("auth: invalid token")
+	// ErrExpiredToken is returned for tokens past their expiry.
+	ErrExpiredToken = errors.New("auth: token expired")
+	// ErrNoSecret is returned when JWT_SECRET is not set.
+	ErrNoSecret = errors.New("auth: JWT_SECRET is not set")
+)
+
+// Claims are the JWT claims of an access token. Subject is the user id.
+type Claims struct {
+	Subject   string `json:"sub"`
+	Email     string `json:"email,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// UserID returns the id of the user the token was issued to.
+func (c Claims) UserID() (int64, error) {
+	id, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return id, nil
+}
+
+// Secret returns the signing secret from JWT_SECRET.
+func Secret() ([]byte, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	return []byte(secret), nil
+}
+
+// jwtHeader is the only header this package signs or accepts.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign returns c as a signed JWT.
+func Sign(secret []byte, c Claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signature(secret, signed), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims.
+// Tokens signed with any algorithm but HS256 are rejected.
+func Verify(secret []byte, token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil || header.Alg != "HS256" {
+		return Claims{}, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signature(secret, parts[0]+"."+parts[1]))) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var c Claims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &c) != nil || c.Subject == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	if now.Unix() >= c.ExpiresAt {
+		return Claims{}, ErrExpiredToken
+	}
+	return c, nil
+}
+
+func signature(secret []byte, signed string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewAccessToken issues an access token for a user that expires after
+// AccessTokenTTL.
+func NewAccessToken(secret []byte, userID int64, email string, now time.Time) (string, error) {
+	return Sign(secret, Claims{
+		Subject:   strconv.FormatInt(userID, 10),
+		Email:     email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+	})
+}
+
+// NewToken returns a random opaque token, such as a refresh or password
+// reset token, and the hash to store for it.
+func NewToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex SHA-256 of an opaque token, which is what gets
+// stored. The tokens are random, so a fast hash is enough.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header, or "".
+func BearerToken(headers map[string]string) string {
+	for name, value := range headers {
+		if !strings.EqualFold(name, "Authorization") {
+			continue
+		}
+		scheme, token, ok := strings.Cut(strings.TrimSpace(value), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
+
+// Authenticate verifies the bearer token of req. It returns ErrNoToken when
+// there is none, which callers that allow anonymous requests can ignore.
+func Authenticate(req events.APIGatewayProxyRequest) (Claims, error) {
+	token := BearerToken(req.Headers)
+	if token == "" {
+		return Claims{}, ErrNoToken
+	}
+	secret, err := Secret()
+	if err != nil {
+		return Claims{}, err
+	}
+	return Verify(secret, token, time.Now())
+}
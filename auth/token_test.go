@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessToken(t *testing.T) {
+	secret := []byte("test-secret")
+	now := time.Unix(1700000000, 0)
+
+	token, err := NewAccessToken(secret, 42, "a@example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := Verify(secret, token, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := claims.UserID(); id != 42 || claims.Email != "a@example.com" {
+		t.Errorf("got claims %+v", claims)
+	}
+
+	if _, err := Verify(secret, token, now.Add(AccessTokenTTL)); err != ErrExpiredToken {
+		t.Errorf("expired token: got %v", err)
+	}
+	if _, err := Verify([]byte("other"), token, now); err != ErrInvalidToken {
+		t.Errorf("wrong secret: got %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	if _, err := Verify(secret, none+"."+parts[1]+".", now); err != ErrInvalidToken {
+		t.Errorf("alg none: got %v", err)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1","iat":0,"exp":9999999999}`))
+	if _, err := Verify(secret, parts[0]+"."+forged+"."+parts[2], now); err != ErrInvalidToken {
+		t.Errorf("tampered payload: got %v", err)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	if got := BearerToken(map[string]string{"authorization": "bearer abc"}); got != "abc" {
+		t.Errorf("got %q", got)
+	}
+	if got := BearerToken(map[string]string{"Authorization": "Basic abc"}); got != "" {
+		t.Errorf("got %q for basic auth", got)
+	}
+}
@@ -0,0 +1,169 @@
+// Package capture records the API Gateway requests a function handles as
+// JSON lines and replays them later, so production traffic can be
+// reproduced against a local database.
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Handler is the signature of a Lambda API Gateway handler.
+type Handler func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// Entry is one recorded request and the response it got.
+type Entry struct {
+	Time     time.Time         `json:"time"`
+	Function string            `json:"function"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Query    map[string]string `json:"query,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Status   int               `json:"status"`
+	Response string            `json:"response,omitempty"`
+}
+
+// Request rebuilds the API Gateway request the entry was recorded from.
+func (e Entry) Request() events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:            e.Method,
+		Path:                  e.Path,
+		QueryStringParameters: e.Query,
+		Headers:               e.Headers,
+		Body:                  e.Body,
+	}
+}
+
+// redacted replaces recorded secrets.
+const redacted = "[redacted]"
+
+// sensitiveHeaders are recorded as redacted.
+var sensitiveHeaders = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"x-api-key":     true,
+}
+
+// Recorder writes an Entry per request to a writer, one JSON object per
+// line. It is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	function string
+}
+
+// NewRecorder returns a Recorder that tags entries with function.
+func NewRecorder(w io.Writer, function string) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), function: function}
+}
+
+// Wrap returns a handler that calls h and records the request and response.
+// Credentials in headers and password or token members of JSON bodies are
+// redacted.
+func (r *Recorder) Wrap(h Handler) Handler {
+	return func(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		resp, err := h(req)
+
+		entry := Entry{
+			Time:     time.Now().UTC(),
+			Function: r.function,
+			Method:   req.HTTPMethod,
+			Path:     req.Path,
+			Query:    req.QueryStringParameters,
+			Headers:  redactHeaders(req.Headers),
+			Body:     redactBody(req.Body),
+			Status:   resp.StatusCode,
+			Response: redactBody(resp.Body),
+		}
+		r.mu.Lock()
+		if encErr := r.enc.Encode(entry); encErr != nil {
+			fmt.Fprintf(os.Stderr, "capture: %v\n", encErr)
+		}
+		r.mu.Unlock()
+
+		return resp, err
+	}
+}
+
+// WrapFromEnv records h's traffic when CAPTURE_FILE is set, appending to
+// that file, or writing to stdout (and so the function logs) for "-".
+// Without CAPTURE_FILE it returns h unchanged.
+func WrapFromEnv(function string, h Handler) (Handler, error) {
+	path := os.Getenv("CAPTURE_FILE")
+	if path == "" {
+		return h, nil
+	}
+	if path == "-" {
+		return NewRecorder(os.Stdout, function).Wrap(h), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f, function).Wrap(h), nil
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if sensitiveHeaders[strings.ToLower(name)] {
+			value = redacted
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// redactBody blanks the values of object members whose names mention a
+// password or token, at any depth. Bodies that are not JSON are kept as
+// they are.
+func redactBody(body string) string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return body
+	}
+	if !redactValue(value) {
+		return body
+	}
+	out, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+	return string(out)
+}
+
+func redactValue(value interface{}) bool {
+	changed := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, member := range v {
+			lower := strings.ToLower(key)
+			if strings.Contains(lower, "password") || strings.Contains(lower, "token") {
+				v[key] = redacted
+				changed = true
+				continue
+			}
+			if redactValue(member) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if redactValue(item) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,48 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	version := 1
+	h := func(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		body, _ := json.Marshal(map[string]interface{}{"id": req.QueryStringParameters["id"], "version": version})
+		return events.APIGatewayProxyResponse{StatusCode: 200, Body: string(body)}, nil
+	}
+
+	var log bytes.Buffer
+	recorded := NewRecorder(&log, "documents").Wrap(h)
+	recorded(events.APIGatewayProxyRequest{
+		HTTPMethod:            "PATCH",
+		QueryStringParameters: map[string]string{"id": "1"},
+		Headers:               map[string]string{"Authorization": "Bearer secret"},
+		Body:                  `{"password":"hunter2"}`,
+	})
+	if strings.Contains(log.String(), "secret") || strings.Contains(log.String(), "hunter2") {
+		t.Fatalf("credentials were recorded: %s", log.String())
+	}
+
+	diffs, replayed, err := Replay(bytes.NewReader(log.Bytes()), "documents", h)
+	if err != nil || replayed != 1 || len(diffs) != 0 {
+		t.Fatalf("identical replay: %d replayed, diffs %v, err %v", replayed, diffs, err)
+	}
+
+	version = 2
+	diffs, _, err = Replay(bytes.NewReader(log.Bytes()), "documents", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || len(diffs[0].Body) != 1 || diffs[0].Body[0].Path != "/version" {
+		t.Fatalf("expected a diff of /version, got %+v", diffs)
+	}
+
+	if _, replayed, _ = Replay(bytes.NewReader(log.Bytes()), "users", h); replayed != 0 {
+		t.Errorf("replayed %d entries recorded for another function", replayed)
+	}
+}
@@ -0,0 +1,134 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/mr-destructive/dummy-json-patch/patch"
+)
+
+// Diff reports a replayed request whose response differs from the recorded
+// one.
+type Diff struct {
+	// Line is the line of the capture file the request was read from.
+	Line       int               `json:"line"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      map[string]string `json:"query,omitempty"`
+	WantStatus int               `json:"wantStatus"`
+	GotStatus  int               `json:"gotStatus"`
+	// Body is the JSON Patch from the recorded response body to the
+	// replayed one, or a replace of the whole body when either is not JSON.
+	Body []patch.Operation `json:"body,omitempty"`
+	// Error is set when the handler returned an error.
+	Error string `json:"error,omitempty"`
+}
+
+// maxLineSize bounds a single capture line.
+const maxLineSize = 10 << 20
+
+// Replay feeds the entries recorded for function back into h in order and
+// returns the ones whose responses differ, along with the number replayed.
+func Replay(r io.Reader, function string, h Handler) ([]Diff, int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	var diffs []Diff
+	replayed := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return diffs, replayed, fmt.Errorf("line %d: %w", line, err)
+		}
+		if entry.Function != function {
+			continue
+		}
+
+		replayed++
+		resp, err := h(entry.Request())
+		diff := Diff{
+			Line:       line,
+			Method:     entry.Method,
+			Path:       entry.Path,
+			Query:      entry.Query,
+			WantStatus: entry.Status,
+			GotStatus:  resp.StatusCode,
+			Body:       bodyDiff(entry.Response, redactBody(resp.Body)),
+		}
+		if err != nil {
+			diff.Error = err.Error()
+		}
+		if diff.Error != "" || diff.WantStatus != diff.GotStatus || len(diff.Body) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, replayed, scanner.Err()
+}
+
+// ReplayFile replays the capture file at path through h, writes a report of
+// the differences to w as JSON lines followed by a summary, and returns the
+// number of differing responses. Recorded credentials are redacted, so
+// requests that sent an Authorization header are replayed with the value of
+// REPLAY_AUTHORIZATION instead, such as a bearer token for the local
+// database.
+func ReplayFile(path, function string, h Handler, w io.Writer) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if authorization := os.Getenv("REPLAY_AUTHORIZATION"); authorization != "" {
+		h = withAuthorization(h, authorization)
+	}
+
+	diffs, replayed, err := Replay(f, function, h)
+	enc := json.NewEncoder(w)
+	for _, diff := range diffs {
+		enc.Encode(diff)
+	}
+	fmt.Fprintf(w, "%s: replayed %d requests, %d responses differ\n", function, replayed, len(diffs))
+	return len(diffs), err
+}
+
+func bodyDiff(want, got string) []patch.Operation {
+	if want == got {
+		return nil
+	}
+	var wantValue, gotValue interface{}
+	if json.Unmarshal([]byte(want), &wantValue) == nil && json.Unmarshal([]byte(got), &gotValue) == nil {
+		if reflect.DeepEqual(wantValue, gotValue) {
+			return nil
+		}
+		if ops, err := patch.Diff(wantValue, gotValue); err == nil {
+			return ops
+		}
+	}
+	raw, _ := json.Marshal(got)
+	return []patch.Operation{{Op: "replace", Path: "", Value: raw}}
+}
+
+// withAuthorization returns a handler that replaces redacted Authorization
+// headers with authorization before calling h.
+func withAuthorization(h Handler, authorization string) Handler {
+	return func(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		headers := make(map[string]string, len(req.Headers))
+		for name, value := range req.Headers {
+			if strings.EqualFold(name, "Authorization") && value == redacted {
+				value = authorization
+			}
+			headers[name] = value
+		}
+		req.Headers = headers
+		return h(req)
+	}
+}
@@ -8,9 +8,54 @@ import (
 	"database/sql"
 )
 
+type AuditLog struct {
+	ID           int64
+	Actor        sql.NullString
+	RequestID    string
+	ResourceType string
+	ResourceID   int64
+	Operation    string
+	Patch        sql.NullString
+	CreatedAt    string
+}
+
 type Document struct {
+	ID      int64
+	Data    sql.NullString
+	Version int64
+}
+
+type DocumentRevision struct {
+	ID         int64
+	DocumentID int64
+	Version    int64
+	Data       sql.NullString
+	Patch      sql.NullString
+	Inverse    sql.NullString
+	CreatedAt  string
+}
+
+type PasswordReset struct {
+	ID        int64
+	UserID    int64
+	TokenHash string
+	ExpiresAt string
+	UsedAt    sql.NullString
+	CreatedAt string
+}
+
+type RefreshToken struct {
+	ID        int64
+	UserID    int64
+	TokenHash string
+	ExpiresAt string
+	RevokedAt sql.NullString
+	CreatedAt string
+}
+
+type Role struct {
 	ID   int64
-	Data sql.NullString
+	Name string
 }
 
 type User struct {
@@ -20,4 +65,33 @@ type User struct {
 	Bio          sql.NullString
 	Roles        sql.NullString
 	PasswordHash string
+	Version      int64
+}
+
+type UserRole struct {
+	UserID   int64
+	RoleID   int64
+	Position int64
+}
+
+type Webhook struct {
+	ID        int64
+	Url       string
+	Events    string
+	Secret    string
+	CreatedAt string
+}
+
+type WebhookDelivery struct {
+	ID            int64
+	WebhookID     int64
+	EventID       string
+	EventType     string
+	Payload       string
+	Attempt       int64
+	StatusCode    sql.NullInt64
+	Error         sql.NullString
+	CreatedAt     string
+	State         string
+	NextAttemptAt sql.NullString
 }
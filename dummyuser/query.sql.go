@@ -10,6 +10,66 @@ import (
 	"database/sql"
 )
 
+const addUserRole = `-- name: AddUserRole :exec
+INSERT INTO user_roles (user_id, role_id, position)
+SELECT ?1, id, ?2 FROM roles WHERE name = ?3
+`
+
+type AddUserRoleParams struct {
+	UserID   int64
+	Position int64
+	Name     string
+}
+
+func (q *Queries) AddUserRole(ctx context.Context, arg AddUserRoleParams) error {
+	_, err := q.db.ExecContext(ctx, addUserRole, arg.UserID, arg.Position, arg.Name)
+	return err
+}
+
+const claimWebhookDelivery = `-- name: ClaimWebhookDelivery :execrows
+UPDATE webhook_deliveries SET next_attempt_at = ?1
+WHERE id = ?2 AND state = 'pending' AND next_attempt_at = ?3
+`
+
+type ClaimWebhookDeliveryParams struct {
+	LeaseUntil sql.NullString
+	ID         int64
+	DueAt      sql.NullString
+}
+
+func (q *Queries) ClaimWebhookDelivery(ctx context.Context, arg ClaimWebhookDeliveryParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, claimWebhookDelivery, arg.LeaseUntil, arg.ID, arg.DueAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const createAuditEntry = `-- name: CreateAuditEntry :exec
+INSERT INTO audit_log (actor, request_id, resource_type, resource_id, operation, patch) VALUES (?, ?, ?, ?, ?, ?)
+`
+
+type CreateAuditEntryParams struct {
+	Actor        sql.NullString
+	RequestID    string
+	ResourceType string
+	ResourceID   int64
+	Operation    string
+	Patch        sql.NullString
+}
+
+func (q *Queries) CreateAuditEntry(ctx context.Context, arg CreateAuditEntryParams) error {
+	_, err := q.db.ExecContext(ctx, createAuditEntry,
+		arg.Actor,
+		arg.RequestID,
+		arg.ResourceType,
+		arg.ResourceID,
+		arg.Operation,
+		arg.Patch,
+	)
+	return err
+}
+
 const createDocument = `-- name: CreateDocument :one
 INSERT INTO document (data) VALUES (?) RETURNING id
 `
@@ -21,15 +81,92 @@ func (q *Queries) CreateDocument(ctx context.Context, data sql.NullString) (int6
 	return id, err
 }
 
+const createDocumentRevision = `-- name: CreateDocumentRevision :one
+INSERT INTO document_revisions (document_id, version, data, patch, inverse) VALUES (?, ?, ?, ?, ?) RETURNING id
+`
+
+type CreateDocumentRevisionParams struct {
+	DocumentID int64
+	Version    int64
+	Data       sql.NullString
+	Patch      sql.NullString
+	Inverse    sql.NullString
+}
+
+func (q *Queries) CreateDocumentRevision(ctx context.Context, arg CreateDocumentRevisionParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createDocumentRevision,
+		arg.DocumentID,
+		arg.Version,
+		arg.Data,
+		arg.Patch,
+		arg.Inverse,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createDocumentWithID = `-- name: CreateDocumentWithID :exec
+INSERT INTO document (id, data) VALUES (?, ?)
+`
+
+type CreateDocumentWithIDParams struct {
+	ID   int64
+	Data sql.NullString
+}
+
+func (q *Queries) CreateDocumentWithID(ctx context.Context, arg CreateDocumentWithIDParams) error {
+	_, err := q.db.ExecContext(ctx, createDocumentWithID, arg.ID, arg.Data)
+	return err
+}
+
+const createPasswordReset = `-- name: CreatePasswordReset :exec
+INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?)
+`
+
+type CreatePasswordResetParams struct {
+	UserID    int64
+	TokenHash string
+	ExpiresAt string
+}
+
+func (q *Queries) CreatePasswordReset(ctx context.Context, arg CreatePasswordResetParams) error {
+	_, err := q.db.ExecContext(ctx, createPasswordReset, arg.UserID, arg.TokenHash, arg.ExpiresAt)
+	return err
+}
+
+const createRefreshToken = `-- name: CreateRefreshToken :exec
+INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES (?, ?, ?)
+`
+
+type CreateRefreshTokenParams struct {
+	UserID    int64
+	TokenHash string
+	ExpiresAt string
+}
+
+func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshTokenParams) error {
+	_, err := q.db.ExecContext(ctx, createRefreshToken, arg.UserID, arg.TokenHash, arg.ExpiresAt)
+	return err
+}
+
+const createRole = `-- name: CreateRole :exec
+INSERT INTO roles (name) VALUES (?) ON CONFLICT (name) DO NOTHING
+`
+
+func (q *Queries) CreateRole(ctx context.Context, name string) error {
+	_, err := q.db.ExecContext(ctx, createRole, name)
+	return err
+}
+
 const createUser = `-- name: CreateUser :one
-INSERT INTO users (name, email, bio, roles, password_hash) VALUES (?, ?, ?, ?, ?) RETURNING id, name, email, bio, roles
+INSERT INTO users (name, email, bio, password_hash) VALUES (?, ?, ?, ?) RETURNING id, name, email, bio
 `
 
 type CreateUserParams struct {
 	Name         string
 	Email        string
 	Bio          sql.NullString
-	Roles        sql.NullString
 	PasswordHash string
 }
 
@@ -38,7 +175,6 @@ type CreateUserRow struct {
 	Name  string
 	Email string
 	Bio   sql.NullString
-	Roles sql.NullString
 }
 
 func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (CreateUserRow, error) {
@@ -46,7 +182,6 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (CreateU
 		arg.Name,
 		arg.Email,
 		arg.Bio,
-		arg.Roles,
 		arg.PasswordHash,
 	)
 	var i CreateUserRow
@@ -55,26 +190,105 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (CreateU
 		&i.Name,
 		&i.Email,
 		&i.Bio,
-		&i.Roles,
 	)
 	return i, err
 }
 
-const deleteDocument = `-- name: DeleteDocument :exec
+const createWebhook = `-- name: CreateWebhook :one
+INSERT INTO webhooks (url, events, secret) VALUES (?, ?, ?) RETURNING id, url, events, secret, created_at
+`
+
+type CreateWebhookParams struct {
+	Url    string
+	Events string
+	Secret string
+}
+
+func (q *Queries) CreateWebhook(ctx context.Context, arg CreateWebhookParams) (Webhook, error) {
+	row := q.db.QueryRowContext(ctx, createWebhook, arg.Url, arg.Events, arg.Secret)
+	var i Webhook
+	err := row.Scan(
+		&i.ID,
+		&i.Url,
+		&i.Events,
+		&i.Secret,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const deleteDocument = `-- name: DeleteDocument :execrows
 DELETE FROM document WHERE id = ?
 `
 
-func (q *Queries) DeleteDocument(ctx context.Context, id int64) error {
-	_, err := q.db.ExecContext(ctx, deleteDocument, id)
-	return err
+func (q *Queries) DeleteDocument(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteDocument, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
-const deleteUser = `-- name: DeleteUser :exec
+const deleteUser = `-- name: DeleteUser :execrows
 DELETE FROM users WHERE id = ?
 `
 
-func (q *Queries) DeleteUser(ctx context.Context, id int64) error {
-	_, err := q.db.ExecContext(ctx, deleteUser, id)
+func (q *Queries) DeleteUser(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteUser, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteUserRoles = `-- name: DeleteUserRoles :exec
+DELETE FROM user_roles WHERE user_id = ?
+`
+
+func (q *Queries) DeleteUserRoles(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteUserRoles, userID)
+	return err
+}
+
+const deleteWebhook = `-- name: DeleteWebhook :execrows
+DELETE FROM webhooks WHERE id = ?
+`
+
+func (q *Queries) DeleteWebhook(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteWebhook, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteWebhookDeliveries = `-- name: DeleteWebhookDeliveries :exec
+DELETE FROM webhook_deliveries WHERE webhook_id = ?
+`
+
+func (q *Queries) DeleteWebhookDeliveries(ctx context.Context, webhookID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteWebhookDeliveries, webhookID)
+	return err
+}
+
+const enqueueWebhookDelivery = `-- name: EnqueueWebhookDelivery :exec
+INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, attempt, state, next_attempt_at) VALUES (?, ?, ?, ?, 0, 'pending', CURRENT_TIMESTAMP)
+`
+
+type EnqueueWebhookDeliveryParams struct {
+	WebhookID int64
+	EventID   string
+	EventType string
+	Payload   string
+}
+
+func (q *Queries) EnqueueWebhookDelivery(ctx context.Context, arg EnqueueWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, enqueueWebhookDelivery,
+		arg.WebhookID,
+		arg.EventID,
+		arg.EventType,
+		arg.Payload,
+	)
 	return err
 }
 
@@ -89,16 +303,92 @@ func (q *Queries) GetDocument(ctx context.Context, id int64) (sql.NullString, er
 	return data, err
 }
 
+const getDocumentRevision = `-- name: GetDocumentRevision :one
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE document_id = ? AND version = ?
+`
+
+type GetDocumentRevisionParams struct {
+	DocumentID int64
+	Version    int64
+}
+
+func (q *Queries) GetDocumentRevision(ctx context.Context, arg GetDocumentRevisionParams) (DocumentRevision, error) {
+	row := q.db.QueryRowContext(ctx, getDocumentRevision, arg.DocumentID, arg.Version)
+	var i DocumentRevision
+	err := row.Scan(
+		&i.ID,
+		&i.DocumentID,
+		&i.Version,
+		&i.Data,
+		&i.Patch,
+		&i.Inverse,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getDocumentWithVersion = `-- name: GetDocumentWithVersion :one
+SELECT data, version FROM document WHERE id = ?
+`
+
+type GetDocumentWithVersionRow struct {
+	Data    sql.NullString
+	Version int64
+}
+
+func (q *Queries) GetDocumentWithVersion(ctx context.Context, id int64) (GetDocumentWithVersionRow, error) {
+	row := q.db.QueryRowContext(ctx, getDocumentWithVersion, id)
+	var i GetDocumentWithVersionRow
+	err := row.Scan(&i.Data, &i.Version)
+	return i, err
+}
+
+const getPasswordReset = `-- name: GetPasswordReset :one
+SELECT id, user_id, token_hash, expires_at, used_at, created_at FROM password_resets WHERE token_hash = ?
+`
+
+func (q *Queries) GetPasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	row := q.db.QueryRowContext(ctx, getPasswordReset, tokenHash)
+	var i PasswordReset
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.TokenHash,
+		&i.ExpiresAt,
+		&i.UsedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getRefreshToken = `-- name: GetRefreshToken :one
+SELECT id, user_id, token_hash, expires_at, revoked_at, created_at FROM refresh_tokens WHERE token_hash = ?
+`
+
+func (q *Queries) GetRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, getRefreshToken, tokenHash)
+	var i RefreshToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.TokenHash,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const getUser = `-- name: GetUser :one
-SELECT id, name, email, bio, roles FROM users WHERE id = ?
+SELECT id, name, email, bio, version FROM users WHERE id = ?
 `
 
 type GetUserRow struct {
-	ID    int64
-	Name  string
-	Email string
-	Bio   sql.NullString
-	Roles sql.NullString
+	ID      int64
+	Name    string
+	Email   string
+	Bio     sql.NullString
+	Version int64
 }
 
 func (q *Queries) GetUser(ctx context.Context, id int64) (GetUserRow, error) {
@@ -109,13 +399,246 @@ func (q *Queries) GetUser(ctx context.Context, id int64) (GetUserRow, error) {
 		&i.Name,
 		&i.Email,
 		&i.Bio,
-		&i.Roles,
+		&i.Version,
+	)
+	return i, err
+}
+
+const getUserByEmail = `-- name: GetUserByEmail :one
+SELECT id, name, email, bio, version FROM users WHERE email = ?
+`
+
+type GetUserByEmailRow struct {
+	ID      int64
+	Name    string
+	Email   string
+	Bio     sql.NullString
+	Version int64
+}
+
+func (q *Queries) GetUserByEmail(ctx context.Context, email string) (GetUserByEmailRow, error) {
+	row := q.db.QueryRowContext(ctx, getUserByEmail, email)
+	var i GetUserByEmailRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Email,
+		&i.Bio,
+		&i.Version,
+	)
+	return i, err
+}
+
+const getUserCredentials = `-- name: GetUserCredentials :one
+SELECT id, email, password_hash FROM users WHERE email = ?
+`
+
+type GetUserCredentialsRow struct {
+	ID           int64
+	Email        string
+	PasswordHash string
+}
+
+func (q *Queries) GetUserCredentials(ctx context.Context, email string) (GetUserCredentialsRow, error) {
+	row := q.db.QueryRowContext(ctx, getUserCredentials, email)
+	var i GetUserCredentialsRow
+	err := row.Scan(&i.ID, &i.Email, &i.PasswordHash)
+	return i, err
+}
+
+const getUserPasswordHash = `-- name: GetUserPasswordHash :one
+SELECT password_hash FROM users WHERE id = ?
+`
+
+func (q *Queries) GetUserPasswordHash(ctx context.Context, id int64) (string, error) {
+	row := q.db.QueryRowContext(ctx, getUserPasswordHash, id)
+	var password_hash string
+	err := row.Scan(&password_hash)
+	return password_hash, err
+}
+
+const getWebhook = `-- name: GetWebhook :one
+SELECT id, url, events, secret, created_at FROM webhooks WHERE id = ?
+`
+
+func (q *Queries) GetWebhook(ctx context.Context, id int64) (Webhook, error) {
+	row := q.db.QueryRowContext(ctx, getWebhook, id)
+	var i Webhook
+	err := row.Scan(
+		&i.ID,
+		&i.Url,
+		&i.Events,
+		&i.Secret,
+		&i.CreatedAt,
 	)
 	return i, err
 }
 
+const invalidatePasswordResets = `-- name: InvalidatePasswordResets :exec
+UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL
+`
+
+func (q *Queries) InvalidatePasswordResets(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, invalidatePasswordResets, userID)
+	return err
+}
+
+const listAuditLog = `-- name: ListAuditLog :many
+SELECT id, actor, request_id, resource_type, resource_id, operation, patch, created_at FROM audit_log
+WHERE (?1 IS NULL OR resource_type = ?1)
+  AND (?2 IS NULL OR resource_id = ?2)
+  AND (?3 IS NULL OR actor = ?3)
+  AND (?4 IS NULL OR created_at >= ?4)
+  AND (?5 IS NULL OR created_at < ?5)
+ORDER BY id DESC LIMIT ?6
+`
+
+type ListAuditLogParams struct {
+	ResourceType sql.NullString
+	ResourceID   sql.NullInt64
+	Actor        sql.NullString
+	Since        sql.NullString
+	Until        sql.NullString
+	Limit        int64
+}
+
+func (q *Queries) ListAuditLog(ctx context.Context, arg ListAuditLogParams) ([]AuditLog, error) {
+	rows, err := q.db.QueryContext(ctx, listAuditLog,
+		arg.ResourceType,
+		arg.ResourceID,
+		arg.Actor,
+		arg.Since,
+		arg.Until,
+		arg.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AuditLog
+	for rows.Next() {
+		var i AuditLog
+		if err := rows.Scan(
+			&i.ID,
+			&i.Actor,
+			&i.RequestID,
+			&i.ResourceType,
+			&i.ResourceID,
+			&i.Operation,
+			&i.Patch,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDueWebhookDeliveries = `-- name: ListDueWebhookDeliveries :many
+SELECT d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.attempt, d.next_attempt_at, w.url, w.secret
+FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+WHERE d.state = 'pending' AND d.next_attempt_at <= ? ORDER BY d.id LIMIT ?
+`
+
+type ListDueWebhookDeliveriesParams struct {
+	NextAttemptAt sql.NullString
+	Limit         int64
+}
+
+type ListDueWebhookDeliveriesRow struct {
+	ID            int64
+	WebhookID     int64
+	EventID       string
+	EventType     string
+	Payload       string
+	Attempt       int64
+	NextAttemptAt sql.NullString
+	Url           string
+	Secret        string
+}
+
+func (q *Queries) ListDueWebhookDeliveries(ctx context.Context, arg ListDueWebhookDeliveriesParams) ([]ListDueWebhookDeliveriesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listDueWebhookDeliveries, arg.NextAttemptAt, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDueWebhookDeliveriesRow
+	for rows.Next() {
+		var i ListDueWebhookDeliveriesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.WebhookID,
+			&i.EventID,
+			&i.EventType,
+			&i.Payload,
+			&i.Attempt,
+			&i.NextAttemptAt,
+			&i.Url,
+			&i.Secret,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDocumentRevisionsSince = `-- name: ListDocumentRevisionsSince :many
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE document_id = ? AND id > ? ORDER BY id
+`
+
+type ListDocumentRevisionsSinceParams struct {
+	DocumentID int64
+	ID         int64
+}
+
+func (q *Queries) ListDocumentRevisionsSince(ctx context.Context, arg ListDocumentRevisionsSinceParams) ([]DocumentRevision, error) {
+	rows, err := q.db.QueryContext(ctx, listDocumentRevisionsSince, arg.DocumentID, arg.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []DocumentRevision
+	for rows.Next() {
+		var i DocumentRevision
+		if err := rows.Scan(
+			&i.ID,
+			&i.DocumentID,
+			&i.Version,
+			&i.Data,
+			&i.Patch,
+			&i.Inverse,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const listDocuments = `-- name: ListDocuments :many
-SELECT id, data FROM document
+SELECT id, data, version FROM document
 `
 
 func (q *Queries) ListDocuments(ctx context.Context) ([]Document, error) {
@@ -127,7 +650,77 @@ func (q *Queries) ListDocuments(ctx context.Context) ([]Document, error) {
 	var items []Document
 	for rows.Next() {
 		var i Document
-		if err := rows.Scan(&i.ID, &i.Data); err != nil {
+		if err := rows.Scan(&i.ID, &i.Data, &i.Version); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDocumentRevisions = `-- name: ListDocumentRevisions :many
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE document_id = ? ORDER BY version
+`
+
+func (q *Queries) ListDocumentRevisions(ctx context.Context, documentID int64) ([]DocumentRevision, error) {
+	rows, err := q.db.QueryContext(ctx, listDocumentRevisions, documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []DocumentRevision
+	for rows.Next() {
+		var i DocumentRevision
+		if err := rows.Scan(
+			&i.ID,
+			&i.DocumentID,
+			&i.Version,
+			&i.Data,
+			&i.Patch,
+			&i.Inverse,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRevisionsSince = `-- name: ListRevisionsSince :many
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE id > ? ORDER BY id
+`
+
+func (q *Queries) ListRevisionsSince(ctx context.Context, id int64) ([]DocumentRevision, error) {
+	rows, err := q.db.QueryContext(ctx, listRevisionsSince, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []DocumentRevision
+	for rows.Next() {
+		var i DocumentRevision
+		if err := rows.Scan(
+			&i.ID,
+			&i.DocumentID,
+			&i.Version,
+			&i.Data,
+			&i.Patch,
+			&i.Inverse,
+			&i.CreatedAt,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -141,8 +734,70 @@ func (q *Queries) ListDocuments(ctx context.Context) ([]Document, error) {
 	return items, nil
 }
 
+const listRoleAssignments = `-- name: ListRoleAssignments :many
+SELECT ur.user_id, r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id ORDER BY ur.user_id, ur.position
+`
+
+type ListRoleAssignmentsRow struct {
+	UserID int64
+	Name   string
+}
+
+func (q *Queries) ListRoleAssignments(ctx context.Context) ([]ListRoleAssignmentsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listRoleAssignments)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRoleAssignmentsRow
+	for rows.Next() {
+		var i ListRoleAssignmentsRow
+		if err := rows.Scan(
+			&i.UserID,
+			&i.Name,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUserRoles = `-- name: ListUserRoles :many
+SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ? ORDER BY ur.position
+`
+
+func (q *Queries) ListUserRoles(ctx context.Context, userID int64) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, listUserRoles, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		items = append(items, name)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const listUsers = `-- name: ListUsers :many
-SELECT id, name, email, bio, roles from users
+SELECT id, name, email, bio from users
 `
 
 type ListUsersRow struct {
@@ -150,7 +805,6 @@ type ListUsersRow struct {
 	Name  string
 	Email string
 	Bio   sql.NullString
-	Roles sql.NullString
 }
 
 func (q *Queries) ListUsers(ctx context.Context) ([]ListUsersRow, error) {
@@ -167,7 +821,6 @@ func (q *Queries) ListUsers(ctx context.Context) ([]ListUsersRow, error) {
 			&i.Name,
 			&i.Email,
 			&i.Bio,
-			&i.Roles,
 		); err != nil {
 			return nil, err
 		}
@@ -182,39 +835,195 @@ func (q *Queries) ListUsers(ctx context.Context) ([]ListUsersRow, error) {
 	return items, nil
 }
 
-const updateDocument = `-- name: UpdateDocument :exec
-UPDATE document SET data = ? WHERE id = ?
+const listWebhookDeliveries = `-- name: ListWebhookDeliveries :many
+SELECT id, webhook_id, event_id, event_type, payload, attempt, status_code, error, created_at, state, next_attempt_at FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?
+`
+
+type ListWebhookDeliveriesParams struct {
+	WebhookID int64
+	Limit     int64
+}
+
+func (q *Queries) ListWebhookDeliveries(ctx context.Context, arg ListWebhookDeliveriesParams) ([]WebhookDelivery, error) {
+	rows, err := q.db.QueryContext(ctx, listWebhookDeliveries, arg.WebhookID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WebhookDelivery
+	for rows.Next() {
+		var i WebhookDelivery
+		if err := rows.Scan(
+			&i.ID,
+			&i.WebhookID,
+			&i.EventID,
+			&i.EventType,
+			&i.Payload,
+			&i.Attempt,
+			&i.StatusCode,
+			&i.Error,
+			&i.CreatedAt,
+			&i.State,
+			&i.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listWebhooks = `-- name: ListWebhooks :many
+SELECT id, url, events, secret, created_at FROM webhooks ORDER BY id
+`
+
+func (q *Queries) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := q.db.QueryContext(ctx, listWebhooks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Webhook
+	for rows.Next() {
+		var i Webhook
+		if err := rows.Scan(
+			&i.ID,
+			&i.Url,
+			&i.Events,
+			&i.Secret,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const revokeRefreshToken = `-- name: RevokeRefreshToken :execrows
+UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE token_hash = ? AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeRefreshToken(ctx context.Context, tokenHash string) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeRefreshToken, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const revokeUserRefreshTokens = `-- name: RevokeUserRefreshTokens :exec
+UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeUserRefreshTokens(ctx context.Context, userID int64) error {
+	_, err := q.db.ExecContext(ctx, revokeUserRefreshTokens, userID)
+	return err
+}
+
+const updateDocument = `-- name: UpdateDocument :execrows
+UPDATE document SET data = ?, version = version + 1 WHERE id = ? AND version = ?
 `
 
 type UpdateDocumentParams struct {
-	Data sql.NullString
-	ID   int64
+	Data    sql.NullString
+	ID      int64
+	Version int64
+}
+
+func (q *Queries) UpdateDocument(ctx context.Context, arg UpdateDocumentParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updateDocument, arg.Data, arg.ID, arg.Version)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
-func (q *Queries) UpdateDocument(ctx context.Context, arg UpdateDocumentParams) error {
-	_, err := q.db.ExecContext(ctx, updateDocument, arg.Data, arg.ID)
+const updateWebhookDelivery = `-- name: UpdateWebhookDelivery :exec
+UPDATE webhook_deliveries SET attempt = ?, state = ?, status_code = ?, error = ?, next_attempt_at = ? WHERE id = ?
+`
+
+type UpdateWebhookDeliveryParams struct {
+	Attempt       int64
+	State         string
+	StatusCode    sql.NullInt64
+	Error         sql.NullString
+	NextAttemptAt sql.NullString
+	ID            int64
+}
+
+func (q *Queries) UpdateWebhookDelivery(ctx context.Context, arg UpdateWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, updateWebhookDelivery,
+		arg.Attempt,
+		arg.State,
+		arg.StatusCode,
+		arg.Error,
+		arg.NextAttemptAt,
+		arg.ID,
+	)
 	return err
 }
 
-const updateUser = `-- name: UpdateUser :exec
-UPDATE users SET name = ?, email = ?, bio = ?, roles = ?  WHERE id = ?
+const updateUser = `-- name: UpdateUser :execrows
+UPDATE users SET name = ?, email = ?, bio = ?, version = version + 1 WHERE id = ? AND version = ?
 `
 
 type UpdateUserParams struct {
-	Name  string
-	Email string
-	Bio   sql.NullString
-	Roles sql.NullString
-	ID    int64
+	Name    string
+	Email   string
+	Bio     sql.NullString
+	ID      int64
+	Version int64
 }
 
-func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) error {
-	_, err := q.db.ExecContext(ctx, updateUser,
+func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updateUser,
 		arg.Name,
 		arg.Email,
 		arg.Bio,
-		arg.Roles,
 		arg.ID,
+		arg.Version,
 	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const updateUserPassword = `-- name: UpdateUserPassword :exec
+UPDATE users SET password_hash = ? WHERE id = ?
+`
+
+type UpdateUserPasswordParams struct {
+	PasswordHash string
+	ID           int64
+}
+
+func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserPassword, arg.PasswordHash, arg.ID)
 	return err
 }
+
+const usePasswordReset = `-- name: UsePasswordReset :execrows
+UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE token_hash = ? AND used_at IS NULL
+`
+
+func (q *Queries) UsePasswordReset(ctx context.Context, tokenHash string) (int64, error) {
+	result, err := q.db.ExecContext(ctx, usePasswordReset, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,15 @@
+package embedsql
+
+import "strings"
+
+// IsConflict reports whether err is SQLite refusing a statement because
+// another transaction holds a conflicting lock. The local driver reports
+// this as "database is locked" and libsql servers as SQLITE_BUSY, so the
+// check is on the error text.
+func IsConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "database is locked")
+}
@@ -0,0 +1,71 @@
+package embedsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestIsConflict(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("database is locked"), true},
+		{errors.New("database is locked (5) (SQLITE_BUSY)"), true},
+		{errors.New("failed to execute SQL: SQLITE_BUSY: database is locked"), true},
+		{errors.New("SQLITE_BUSY_SNAPSHOT"), true},
+		{fmt.Errorf("committing: %w", errors.New("database is locked")), true},
+		{errors.New("UNIQUE constraint failed: users.username"), false},
+		{sql.ErrNoRows, false},
+		{sql.ErrTxDone, false},
+	}
+	for _, tt := range tests {
+		if got := IsConflict(tt.err); got != tt.want {
+			t.Errorf("IsConflict(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestIsConflictDriver checks the text against what the local driver
+// actually returns when two writers collide.
+func TestIsConflictDriver(t *testing.T) {
+	ctx := context.Background()
+	dsn := "file:" + filepath.Join(t.TempDir(), "lock.db") + "?_busy_timeout=0"
+	first, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if _, err := first.ExecContext(ctx, "CREATE TABLE t (v INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := first.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = second.ExecContext(ctx, "INSERT INTO t VALUES (2)")
+	if err == nil {
+		t.Fatal("second writer was not blocked")
+	}
+	if !IsConflict(err) {
+		t.Errorf("IsConflict(%q) = false", err)
+	}
+}
@@ -0,0 +1,151 @@
+package embedsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// addedColumns lists columns added to tables after they were first created.
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone, so Migrate adds
+// these to databases that predate them.
+var addedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "version", "INTEGER NOT NULL DEFAULT 1"},
+	{"document", "version", "INTEGER NOT NULL DEFAULT 1"},
+	{"document_revisions", "inverse", "TEXT"},
+	{"webhook_deliveries", "state", "TEXT NOT NULL DEFAULT 'delivered'"},
+	{"webhook_deliveries", "next_attempt_at", "TEXT"},
+}
+
+// backfills are statements that populate tables and columns added after
+// data already existed. They run in the same transaction as the schema
+// changes. Keep them idempotent, as every bump of schemaVersion runs them
+// again.
+var backfills = []string{
+	// Give every document a revision for its current version so history
+	// starts somewhere for documents written before revisions existed.
+	`INSERT INTO document_revisions (document_id, version, data)
+	SELECT d.id, d.version, d.data FROM document d
+	WHERE NOT EXISTS (SELECT 1 FROM document_revisions r WHERE r.document_id = d.id)`,
+
+	// Rows from before deliveries were queued each record one attempt;
+	// mark the unsuccessful ones failed rather than delivered.
+	`UPDATE webhook_deliveries SET state = 'failed'
+	WHERE state = 'delivered' AND (status_code IS NULL OR status_code >= 300)`,
+
+	// Move roles from the users.roles column to roles and user_roles, then
+	// clear the column so they are only moved once.
+	legacyRoles + `INSERT OR IGNORE INTO roles (name) SELECT DISTINCT name FROM legacy_roles`,
+	legacyRoles + `INSERT OR IGNORE INTO user_roles (user_id, role_id, position)
+	SELECT l.user_id, r.id, l.position FROM legacy_roles l JOIN roles r ON r.name = l.name`,
+	`UPDATE users SET roles = NULL WHERE roles IS NOT NULL`,
+}
+
+// legacyRoles splits users.roles into one row per user and role name. The
+// column holds a JSON array, or names separated by commas or whitespace,
+// which are rewritten as a JSON array so json_each can split both.
+const legacyRoles = `WITH legacy AS (
+	SELECT id, CASE WHEN json_valid(roles) AND json_type(roles) = 'array' THEN roles
+	ELSE '["' || replace(replace(replace(replace(replace(replace(replace(roles,
+		'\', ''), '"', ''), char(9), ','), char(10), ','), char(13), ','), ' ', ','), ',', '","') || '"]'
+	END AS list
+	FROM users WHERE roles IS NOT NULL
+), legacy_roles AS (
+	SELECT legacy.id AS user_id, lower(trim(j.value)) AS name, MIN(j.key) AS position
+	FROM legacy, json_each(legacy.list) j
+	WHERE trim(j.value) <> ''
+	GROUP BY legacy.id, lower(trim(j.value))
+)
+`
+
+// schemaVersion is recorded in PRAGMA user_version once a database has been
+// migrated. Bump it when DDL, addedColumns or backfills change so Migrate
+// runs again.
+const schemaVersion = 1
+
+// Migrate brings a database up to schemaVersion: it creates any missing
+// tables from DDL, adds any missing columns and runs the backfills, in one
+// transaction that records the new version. A database already at
+// schemaVersion is left alone, so only the first request after a deploy
+// pays for it.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	current, err := userVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current >= schemaVersion {
+		return nil
+	}
+	if err := migrateSchema(ctx, db); err != nil {
+		// A concurrent Migrate that got there first makes this one fail
+		// on its writes; that is fine once the version is current.
+		if current, verr := userVersion(ctx, db); verr != nil || current < schemaVersion {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateSchema(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := userVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if current >= schemaVersion {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, DDL); err != nil {
+		return err
+	}
+
+	for _, c := range addedColumns {
+		var count int
+		err := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", c.table, c.column,
+		).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range backfills {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", schemaVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func userVersion(ctx context.Context, q queryer) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, err
+}
@@ -3,14 +3,15 @@ module github.com/mr-destructive/dummy-json-patch
 go 1.23.3
 
 require (
+	github.com/aws/aws-lambda-go v1.47.0
 	github.com/evanphx/json-patch v0.5.2
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/tursodatabase/libsql-client-go v0.0.0-20240902231107-85af5b9d094d
 	golang.org/x/crypto v0.31.0
 )
 
 require (
 	github.com/antlr4-go/antlr/v4 v4.13.0 // indirect
-	github.com/aws/aws-lambda-go v1.47.0 // indirect
 	github.com/coder/websocket v1.8.12 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/exp v0.0.0-20240325151524-a685a6edb6d8 // indirect
@@ -0,0 +1,96 @@
+// Package mailer sends the emails the functions need, such as password
+// reset links, through a pluggable Sender.
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message is an email to send.
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Sender delivers messages.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// LogSender writes messages to a logger instead of sending them, for local
+// development. A nil Logger uses the standard logger.
+type LogSender struct {
+	Logger *log.Logger
+}
+
+func (s LogSender) Send(ctx context.Context, m Message) error {
+	logger := s.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("mail to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// FileSender appends messages to a file as JSON lines, for tests and local
+// development.
+type FileSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (s *FileSender) Send(ctx context.Context, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(struct {
+		Time time.Time `json:"time"`
+		Message
+	}{time.Now().UTC(), m})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ErrNotConfigured is returned by FromEnv when MAIL_SENDER is not set.
+var ErrNotConfigured = errors.New("mailer: MAIL_SENDER is not set")
+
+// FromEnv returns the Sender chosen by MAIL_SENDER: "log" for a LogSender,
+// or "file" for a FileSender writing to MAIL_FILE. There is no default, as
+// both write the messages, and any tokens in them, where operators can read
+// them.
+func FromEnv() (Sender, error) {
+	switch kind := os.Getenv("MAIL_SENDER"); kind {
+	case "":
+		return nil, ErrNotConfigured
+	case "log":
+		return LogSender{}, nil
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			return nil, errors.New("mailer: MAIL_SENDER=file needs MAIL_FILE")
+		}
+		return &FileSender{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown MAIL_SENDER %q", kind)
+	}
+}
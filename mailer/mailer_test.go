@@ -0,0 +1,83 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.jsonl")
+	s := &FileSender{Path: path}
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		if err := s.Send(context.Background(), Message{To: to, Subject: "Hi", Body: "Hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []Message
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+	if len(got) != 2 || got[1].To != "b@example.com" || got[0].Subject != "Hi" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mail.jsonl")
+	tests := []struct {
+		sender, file string
+		want         Sender
+		wantErr      bool
+	}{
+		{"", "", nil, true},
+		{"", file, nil, true},
+		{"log", "", LogSender{}, false},
+		{"file", file, &FileSender{Path: file}, false},
+		{"file", "", nil, true},
+		{"smtp", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAIL_SENDER", tt.sender)
+		t.Setenv("MAIL_FILE", tt.file)
+		got, err := FromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("MAIL_SENDER=%q MAIL_FILE=%q: err = %v", tt.sender, tt.file, err)
+			continue
+		}
+		switch want := tt.want.(type) {
+		case nil:
+			if got != nil {
+				t.Errorf("MAIL_SENDER=%q: got %#v, want nil", tt.sender, got)
+			}
+		case *FileSender:
+			if fs, ok := got.(*FileSender); !ok || fs.Path != want.Path {
+				t.Errorf("MAIL_SENDER=%q: got %#v, want %#v", tt.sender, got, want)
+			}
+		default:
+			if got != want {
+				t.Errorf("MAIL_SENDER=%q: got %#v, want %#v", tt.sender, got, want)
+			}
+		}
+	}
+
+	t.Setenv("MAIL_SENDER", "")
+	if _, err := FromEnv(); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("unset MAIL_SENDER: err = %v, want ErrNotConfigured", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/mr-destructive/dummy-json-patch/audit"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+	"github.com/mr-destructive/dummy-json-patch/embedsql"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+)
+
+// defaultLimit and maxLimit bound how many entries a query returns.
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// timestampLayout is how SQLite's CURRENT_TIMESTAMP formats created_at.
+const timestampLayout = "2006-01-02 15:04:05"
+
+var queries *data.Queries
+
+func main() {
+	lambda.Start(handler)
+}
+
+func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx := context.Background()
+	dbString := os.Getenv("DB_URL")
+	if dbString == "" {
+		dbString = fmt.Sprintf("libsql://%s?authToken=%s", os.Getenv("DB_NAME"), os.Getenv("DB_TOKEN"))
+	}
+	db, err := sql.Open("libsql", dbString)
+	if err != nil {
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Database connection failed"), nil
+	}
+	defer db.Close()
+	if err := embedsql.Migrate(ctx, db); err != nil {
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Database migration failed"), nil
+	}
+	queries = data.New(db)
+
+	ctx, status, err := auth.Authorize(ctx, queries, req, auth.ReadAuditLog)
+	if err != nil {
+		return auth.DenyResponse(status, err, auth.ReadAuditLog), nil
+	}
+
+	if req.HTTPMethod != "GET" {
+		return errorResponse(http.StatusMethodNotAllowed, "Method not allowed"), nil
+	}
+	return handleList(ctx, req.QueryStringParameters)
+}
+
+// entryResponse is an audit log entry as the API shows it.
+type entryResponse struct {
+	ID         int64           `json:"id"`
+	Actor      *string         `json:"actor"`
+	RequestID  string          `json:"requestId"`
+	Resource   string          `json:"resource"`
+	ResourceID int64           `json:"resourceId"`
+	Operation  string          `json:"operation"`
+	Patch      json.RawMessage `json:"patch,omitempty"`
+	Time       string          `json:"time"`
+}
+
+// handleList returns the newest audit log entries first, filtered by the
+// query parameters:
+//
+//	resource  "document" or "user"
+//	id        the id of the resource; needs resource
+//	actor     who made the change
+//	since     entries at or after this time (RFC 3339 or YYYY-MM-DD)
+//	until     entries before this time (RFC 3339 or YYYY-MM-DD)
+//	limit     at most this many entries, 100 by default
+func handleList(ctx context.Context, params map[string]string) (events.APIGatewayProxyResponse, error) {
+	var arg data.ListAuditLogParams
+
+	if resource := params["resource"]; resource != "" {
+		if resource != audit.Document && resource != audit.User {
+			return errorResponse(http.StatusBadRequest, `resource must be "document" or "user"`), nil
+		}
+		arg.ResourceType = sql.NullString{String: resource, Valid: true}
+	}
+	if idStr := params["id"]; idStr != "" {
+		if !arg.ResourceType.Valid {
+			return errorResponse(http.StatusBadRequest, "id needs resource"), nil
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid id"), nil
+		}
+		arg.ResourceID = sql.NullInt64{Int64: id, Valid: true}
+	}
+	if actor := params["actor"]; actor != "" {
+		arg.Actor = sql.NullString{String: actor, Valid: true}
+	}
+
+	for _, bound := range []struct {
+		name string
+		dst  *sql.NullString
+	}{
+		{"since", &arg.Since},
+		{"until", &arg.Until},
+	} {
+		value := params[bound.name]
+		if value == "" {
+			continue
+		}
+		t, err := parseTime(value)
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("Invalid %s: use RFC 3339 or YYYY-MM-DD", bound.name)), nil
+		}
+		*bound.dst = sql.NullString{String: t.UTC().Format(timestampLayout), Valid: true}
+	}
+
+	arg.Limit = defaultLimit
+	if limitStr := params["limit"]; limitStr != "" {
+		limit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit)), nil
+		}
+		arg.Limit = limit
+	}
+
+	entries, err := queries.ListAuditLog(ctx, arg)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to query audit log"), nil
+	}
+
+	list := make([]entryResponse, len(entries))
+	for i, e := range entries {
+		list[i] = entryResponse{
+			ID:         e.ID,
+			RequestID:  e.RequestID,
+			Resource:   e.ResourceType,
+			ResourceID: e.ResourceID,
+			Operation:  e.Operation,
+			Time:       e.CreatedAt,
+		}
+		if e.Actor.Valid {
+			actor := e.Actor.String
+			list[i].Actor = &actor
+		}
+		if e.Patch.Valid {
+			list[i].Patch = json.RawMessage(e.Patch.String)
+		}
+	}
+	return jsonResponse(http.StatusOK, list), nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func jsonResponse(statusCode int, data interface{}) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(data)
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
+
+func errorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	return jsonResponse(statusCode, map[string]string{"error": message})
+}
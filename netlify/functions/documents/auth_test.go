@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/mr-destructive/dummy-json-patch/auth"
+)
+
+func TestAuthorization(t *testing.T) {
+	newTestDB(t)
+	editor := userToken(t, auth.RoleEditor)
+	viewer := userToken(t, auth.RoleViewer)
+	noRoles := userToken(t)
+	id := strconv.FormatInt(createDocument(t, editor, `{"a":1}`), 10)
+	patchHeaders := func() map[string]string {
+		return map[string]string{"Content-Type": "application/json-patch+json"}
+	}
+	patchBody := `[{"op":"replace","path":"/a","value":2}]`
+
+	cases := []struct {
+		name      string
+		readAuth  bool
+		method    string
+		token     string
+		query     map[string]string
+		body      string
+		headers   map[string]string
+		status    int
+		challenge string
+	}{
+		{name: "anonymous read", method: "GET", query: map[string]string{"id": id}, status: http.StatusOK},
+		{name: "anonymous revision list", method: "GET", query: map[string]string{"id": id, "action": "revisions"}, status: http.StatusOK},
+		{name: "anonymous diff", method: "POST", query: map[string]string{"action": "diff"}, body: `{"from":{},"to":{"a":1}}`, status: http.StatusOK},
+		{name: "read by a user without roles", method: "GET", token: noRoles, query: map[string]string{"id": id}, status: http.StatusOK},
+		{name: "read with an invalid token", method: "GET", token: "abc", query: map[string]string{"id": id}, status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "anonymous read when reads need auth", readAuth: true, method: "GET", query: map[string]string{"id": id}, status: http.StatusUnauthorized, challenge: "Bearer"},
+		{name: "read by a user without roles when reads need auth", readAuth: true, method: "GET", token: noRoles, query: map[string]string{"id": id}, status: http.StatusForbidden},
+		{name: "viewer read when reads need auth", readAuth: true, method: "GET", token: viewer, query: map[string]string{"id": id}, status: http.StatusOK},
+		{name: "anonymous create", method: "POST", body: `{}`, status: http.StatusUnauthorized, challenge: "Bearer"},
+		{name: "anonymous patch", method: "PATCH", query: map[string]string{"id": id}, body: patchBody, headers: patchHeaders(), status: http.StatusUnauthorized, challenge: "Bearer"},
+		{name: "viewer patch", method: "PATCH", token: viewer, query: map[string]string{"id": id}, body: patchBody, headers: patchHeaders(), status: http.StatusForbidden},
+		{name: "viewer delete", method: "DELETE", token: viewer, query: map[string]string{"id": id}, status: http.StatusForbidden},
+		{name: "editor patch", method: "PATCH", token: editor, query: map[string]string{"id": id}, body: patchBody, headers: patchHeaders(), status: http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.readAuth {
+				t.Setenv("DOCUMENTS_READ_AUTH", "required")
+			}
+			resp := request(t, c.method, c.token, c.body, c.query, c.headers)
+			if resp.StatusCode != c.status {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, c.status)
+			}
+			if got := resp.Headers["WWW-Authenticate"]; got != c.challenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, c.challenge)
+			}
+		})
+	}
+}
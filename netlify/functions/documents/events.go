@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+)
+
+// changeEvent is one entry of the document change feed. Writes produce a
+// "patch" event carrying the revision they created; deletes produce a
+// "delete" event.
+type changeEvent struct {
+	// ID is the id of the revision the change produced and doubles as the
+	// SSE event id. Deletes create no revision and have ID 0.
+	ID         int64           `json:"-"`
+	Type       string          `json:"type"`
+	DocumentID int64           `json:"id"`
+	Version    int64           `json:"version,omitempty"`
+	Patch      json.RawMessage `json:"patch,omitempty"`
+}
+
+func revisionEvent(rev data.DocumentRevision) changeEvent {
+	ev := changeEvent{
+		ID:         rev.ID,
+		Type:       "patch",
+		DocumentID: rev.DocumentID,
+		Version:    rev.Version,
+	}
+	if rev.Patch.Valid {
+		ev.Patch = json.RawMessage(rev.Patch.String)
+	}
+	return ev
+}
+
+type pendingEventsKey struct{}
+
+// notify queues ev to be published when the transaction running the current
+// request commits. Outside inTx it does nothing.
+func notify(ctx context.Context, ev changeEvent) {
+	if pending, ok := ctx.Value(pendingEventsKey{}).(*[]changeEvent); ok {
+		*pending = append(*pending, ev)
+	}
+}
+
+// pendingMark returns the number of events queued so far, for a later
+// discardPending.
+func pendingMark(ctx context.Context) int {
+	if pending, ok := ctx.Value(pendingEventsKey{}).(*[]changeEvent); ok {
+		return len(*pending)
+	}
+	return 0
+}
+
+// discardPending drops the events queued since mark, for writes that were
+// rolled back to a savepoint.
+func discardPending(ctx context.Context, mark int) {
+	if pending, ok := ctx.Value(pendingEventsKey{}).(*[]changeEvent); ok && mark <= len(*pending) {
+		*pending = (*pending)[:mark]
+	}
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is dropped.
+const subscriberBuffer = 64
+
+// feed fans committed changes out to change feed subscribers in this
+// process.
+var feed = &broker{subs: make(map[*subscriber]struct{})}
+
+type broker struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	// docID limits the subscription to one document; 0 means the whole
+	// collection.
+	docID  int64
+	events chan changeEvent
+}
+
+func (b *broker) subscribe(docID int64) *subscriber {
+	s := &subscriber{docID: docID, events: make(chan changeEvent, subscriberBuffer)}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+func (b *broker) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+// publish delivers events to every interested subscriber without blocking.
+// A subscriber whose buffer is full is dropped; its stream ends and the
+// client catches up by reconnecting with Last-Event-ID.
+func (b *broker) publish(events []changeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		for _, ev := range events {
+			if s.docID != 0 && s.docID != ev.DocumentID {
+				continue
+			}
+			select {
+			case s.events <- ev:
+			default:
+				delete(b.subs, s)
+				close(s.events)
+			}
+			if _, ok := b.subs[s]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// keepaliveInterval is how often an idle change feed sends a comment to keep
+// proxies from closing the connection.
+const keepaliveInterval = 30 * time.Second
+
+// serveEvents streams the change feed for ?id=N, or for every document
+// without an id, as Server-Sent Events. A client reconnecting with
+// Last-Event-ID first receives the revisions it missed from the revision
+// log. Deletes are only delivered live.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var docID int64
+	if idStr := r.URL.Query().Get("id"); idStr != "" {
+		var err error
+		docID, err = strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid document ID", http.StatusBadRequest)
+			return
+		}
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	var since int64
+	if lastEventID != "" {
+		var err error
+		since, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before reading the revision log so nothing committed in
+	// between is missed; replayed revisions are skipped when they arrive
+	// live as well.
+	sub := feed.subscribe(docID)
+	defer feed.unsubscribe(sub)
+
+	var missed []data.DocumentRevision
+	if lastEventID != "" {
+		var err error
+		if docID != 0 {
+			missed, err = queries.ListDocumentRevisionsSince(r.Context(), data.ListDocumentRevisionsSinceParams{
+				DocumentID: docID,
+				ID:         since,
+			})
+		} else {
+			missed, err = queries.ListRevisionsSince(r.Context(), since)
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	replayed := make(map[int64]bool, len(missed))
+	for _, rev := range missed {
+		writeEvent(w, revisionEvent(rev))
+		replayed[rev.ID] = true
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if replayed[ev.ID] {
+				continue
+			}
+			writeEvent(w, ev)
+			flusher.Flush()
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w io.Writer, ev changeEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("change feed: %v", err)
+		return
+	}
+	if ev.ID != 0 {
+		fmt.Fprintf(w, "id: %d\n", ev.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, payload)
+}
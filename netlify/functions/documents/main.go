@@ -4,19 +4,25 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
-	"reflect"
 	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/mr-destructive/dummy-json-patch/audit"
+	"github.com/mr-destructive/dummy-json-patch/capture"
 	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
 	"github.com/mr-destructive/dummy-json-patch/embedsql"
+	"github.com/mr-destructive/dummy-json-patch/patch"
+	"github.com/mr-destructive/dummy-json-patch/webhook"
 	_ "github.com/tursodatabase/libsql-client-go/libsql"
 )
 
@@ -26,59 +32,290 @@ var (
 )
 
 func main() {
-	lambda.Start(handler)
+	replayFile := flag.String("replay", "", "replay a capture file and report responses that differ")
+	flag.Parse()
+	if *replayFile != "" {
+		diffs, err := capture.ReplayFile(*replayFile, "documents", handler, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if diffs > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if addr := os.Getenv("HTTP_ADDR"); addr != "" {
+		log.Fatal(serve(addr))
+	}
+	h, err := capture.WrapFromEnv("documents", handler)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(h)
 }
 
 func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	ctx := context.Background()
-	dbName := os.Getenv("DB_NAME")
-	dbToken := os.Getenv("DB_TOKEN")
-
-	var err error
-	dbString := fmt.Sprintf("libsql://%s?authToken=%s", dbName, dbToken)
-	db, err := sql.Open("libsql", dbString)
+	db, err := openDB(ctx)
 	if err != nil {
+		log.Print(err)
 		return errorResponse(http.StatusInternalServerError, "Database connection failed"), nil
 	}
 	defer db.Close()
 
-	queries = data.New(db)
-	if _, err := db.ExecContext(ctx, embedsql.DDL); err != nil {
-		log.Fatal(err)
+	return route(ctx, req)
+}
+
+// openDB connects to the database at DB_URL, or else the one named by
+// DB_NAME and DB_TOKEN, brings its schema up to date and points queries and
+// sqlDB at it.
+func openDB(ctx context.Context) (*sql.DB, error) {
+	dbString := os.Getenv("DB_URL")
+	if dbString == "" {
+		dbString = fmt.Sprintf("libsql://%s?authToken=%s", os.Getenv("DB_NAME"), os.Getenv("DB_TOKEN"))
+	}
+	db, err := sql.Open("libsql", dbString)
+	if err != nil {
+		return nil, err
+	}
+	if err := embedsql.Migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
+	sqlDB = db
+	queries = data.New(db)
+	hooks = webhook.NewDispatcher(queries)
+	return db, nil
+}
+
+// route dispatches a request on its method and action parameter.
+func route(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	docIDStr := req.QueryStringParameters["id"]
 	var docID int64
 	if docIDStr != "" {
 		docID, _ = strconv.ParseInt(docIDStr, 10, 64)
 	}
 
+	opts, err := requestOptionsFrom(req)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+	ctx, denied := authorize(ctx, req, requiredPermission(req))
+	if denied != nil {
+		return *denied, nil
+	}
+	ctx = audit.WithRequest(ctx, auditRequest(ctx, req))
+
 	switch req.HTTPMethod {
 	case "GET":
-		return handleGet(ctx, docID)
+		switch req.QueryStringParameters["action"] {
+		case "revisions":
+			return handleRevisions(ctx, docID)
+		case "events":
+			return errorResponse(http.StatusNotImplemented, "The change feed needs a long-lived connection; run the function as a server with HTTP_ADDR"), nil
+		}
+		if version := req.QueryStringParameters["version"]; version != "" {
+			return handleGetRevision(ctx, docID, version)
+		}
+		return handleGet(ctx, docID, opts)
 	case "POST":
-		return handlePost(ctx, req.Body)
+		switch req.QueryStringParameters["action"] {
+		case "diff":
+			return handleDiff(ctx, docID, req.Body, req.QueryStringParameters)
+		case "batch":
+			return inTx(ctx, audit.Patch, func(ctx context.Context, q *data.Queries, tx *sql.Tx) (events.APIGatewayProxyResponse, error) {
+				return handleBatch(ctx, q, tx, req.Body, req.QueryStringParameters["continueOnError"] == "true", opts)
+			})
+		case "revert":
+			return inTx(ctx, audit.Revert, func(ctx context.Context, q *data.Queries, _ *sql.Tx) (events.APIGatewayProxyResponse, error) {
+				return handleRevert(ctx, q, docID, req.QueryStringParameters, opts)
+			})
+		}
+		return inTx(ctx, audit.Create, func(ctx context.Context, q *data.Queries, _ *sql.Tx) (events.APIGatewayProxyResponse, error) {
+			return handlePost(ctx, q, req.Body, opts)
+		})
 	case "PUT":
-		return handlePut(ctx, docID, req.Body)
+		return inTx(ctx, audit.Replace, func(ctx context.Context, q *data.Queries, _ *sql.Tx) (events.APIGatewayProxyResponse, error) {
+			return handlePut(ctx, q, docID, req.Body, opts)
+		})
 	case "PATCH":
-		return handlePatch(ctx, docID, req.Body, getHeader(req.Headers, "Content-Type"))
+		return inTx(ctx, audit.Patch, func(ctx context.Context, q *data.Queries, _ *sql.Tx) (events.APIGatewayProxyResponse, error) {
+			return handlePatch(ctx, q, docID, req.Body, opts)
+		})
 	case "DELETE":
-		return handleDelete(ctx, docID)
+		return inTx(ctx, audit.Delete, func(ctx context.Context, q *data.Queries, _ *sql.Tx) (events.APIGatewayProxyResponse, error) {
+			return handleDelete(ctx, q, docID, opts)
+		})
 	default:
 		return errorResponse(http.StatusMethodNotAllowed, "Method not allowed"), nil
 	}
 }
 
-func handleGet(ctx context.Context, docID int64) (events.APIGatewayProxyResponse, error) {
+// requestOptions carries the request-level settings of a write.
+type requestOptions struct {
+	contentType string
+	mode        patch.Mode
+	dryRun      bool
+	// returnPref is the Prefer return preference: "minimal",
+	// "representation", "patch-result" or "" for the default body.
+	returnPref string
+	// location is the path documents are addressed under, for Location
+	// headers.
+	location    string
+	ifMatch     string
+	ifNoneMatch string
+	// baseRevision is the version a JSON Patch was written against, from
+	// the Base-Revision header, or 0 when the patch targets the current
+	// version.
+	baseRevision int64
+}
+
+func requestOptionsFrom(req events.APIGatewayProxyRequest) (requestOptions, error) {
+	mode, err := patchMode(req)
+	if err != nil {
+		return requestOptions{}, err
+	}
+	prefs := preferences(req.Headers)
+	_, preferDryRun := prefs["dry-run"]
+
+	returnPref := prefs["return"]
+	switch returnPref {
+	case "", "minimal", "representation", "patch-result":
+	default:
+		returnPref = ""
+	}
+
+	var baseRevision int64
+	if base := getHeader(req.Headers, "Base-Revision"); base != "" {
+		baseRevision, err = strconv.ParseInt(base, 10, 64)
+		if err != nil || baseRevision < 1 {
+			return requestOptions{}, fmt.Errorf("invalid Base-Revision %q", base)
+		}
+	}
+
+	return requestOptions{
+		contentType:  getHeader(req.Headers, "Content-Type"),
+		mode:         mode,
+		dryRun:       req.QueryStringParameters["dryRun"] == "true" || preferDryRun,
+		returnPref:   returnPref,
+		location:     req.Path,
+		ifMatch:      getHeader(req.Headers, "If-Match"),
+		ifNoneMatch:  getHeader(req.Headers, "If-None-Match"),
+		baseRevision: baseRevision,
+	}, nil
+}
+
+// preconditionFailed evaluates If-Match and If-None-Match against the
+// current state of a document. exists is false when there is no document.
+func (o requestOptions) preconditionFailed(exists bool, version int64) bool {
+	if o.ifMatch != "" {
+		if !exists || (o.ifMatch != "*" && !etagListContains(o.ifMatch, etag(version), false)) {
+			return true
+		}
+	}
+	if o.ifNoneMatch != "" && exists {
+		if o.ifNoneMatch == "*" || etagListContains(o.ifNoneMatch, etag(version), true) {
+			return true
+		}
+	}
+	return false
+}
+
+// concurrentUpdateResponse reports a write that lost a race with another
+// writer: 412 when the client made it conditional with If-Match, 409
+// otherwise.
+func concurrentUpdateResponse(opts requestOptions) events.APIGatewayProxyResponse {
+	if opts.ifMatch != "" {
+		return errorResponse(http.StatusPreconditionFailed, "Document was modified concurrently")
+	}
+	return errorResponse(http.StatusConflict, "Document was modified concurrently, retry the request")
+}
+
+// inTx runs a write handler in a database transaction, giving it the
+// transaction and queries bound to it. The transaction commits only if the
+// handler responds with a success status; error responses roll back
+// everything the handler wrote. Losing a write conflict to another
+// transaction gives 409. Each change the handler queued with notify is
+// written to the audit log as part of the transaction, labelled with
+// operation unless it created or deleted the document, and published to the
+// change feed once the transaction has committed. Webhook deliveries for
+// them are queued in the transaction and first attempted after the commit.
+func inTx(ctx context.Context, operation string, fn func(ctx context.Context, q *data.Queries, tx *sql.Tx) (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		if embedsql.IsConflict(err) {
+			return errorResponse(http.StatusConflict, "Database is busy with a concurrent write, retry the request"), nil
+		}
+		return errorResponse(http.StatusInternalServerError, "Failed to start transaction"), nil
+	}
+	defer tx.Rollback()
+
+	var pending []changeEvent
+	ctx = context.WithValue(ctx, pendingEventsKey{}, &pending)
+	q := queries.WithTx(tx)
+	resp, err := fn(ctx, q, tx)
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		return resp, err
+	}
+	if err := recordAudit(ctx, q, operation, pending); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to write audit log"), nil
+	}
+	if err := webhook.Enqueue(ctx, q, webhookEvents(pending)); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to queue webhook deliveries"), nil
+	}
+	if err := tx.Commit(); err != nil {
+		if embedsql.IsConflict(err) {
+			return errorResponse(http.StatusConflict, "Transaction conflicted with a concurrent write, retry the request"), nil
+		}
+		return errorResponse(http.StatusInternalServerError, "Failed to commit transaction"), nil
+	}
+	feed.publish(pending)
+	if len(pending) > 0 {
+		hooks.SendAfterCommit(ctx)
+	}
+	return resp, nil
+}
+
+// recordAudit writes an audit log entry for each change.
+func recordAudit(ctx context.Context, q *data.Queries, operation string, changes []changeEvent) error {
+	for _, ch := range changes {
+		op := operation
+		switch {
+		case ch.Type == "delete":
+			op = audit.Delete
+		case ch.Version == 1:
+			op = audit.Create
+		}
+		if err := audit.Record(ctx, q, audit.Document, ch.DocumentID, op, ch.Patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleGet(ctx context.Context, docID int64, opts requestOptions) (events.APIGatewayProxyResponse, error) {
 	if docID != 0 {
-		doc, err := queries.GetDocument(ctx, docID)
+		doc, err := queries.GetDocumentWithVersion(ctx, docID)
 		if err == sql.ErrNoRows {
 			return errorResponse(http.StatusNotFound, "Document not found"), nil
 		}
 		if err != nil {
 			return errorResponse(http.StatusInternalServerError, "Failed to fetch document"), nil
 		}
-		return jsonResponse(http.StatusOK, doc), nil
+
+		tag := etag(doc.Version)
+		if opts.ifNoneMatch != "" && (opts.ifNoneMatch == "*" || etagListContains(opts.ifNoneMatch, tag, true)) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotModified,
+				Headers:    map[string]string{"ETag": tag},
+			}, nil
+		}
+
+		resp := jsonResponse(http.StatusOK, doc.Data)
+		resp.Headers["ETag"] = tag
+		return resp, nil
 	}
 
 	docs, err := queries.ListDocuments(ctx)
@@ -88,13 +325,13 @@ func handleGet(ctx context.Context, docID int64) (events.APIGatewayProxyResponse
 	return jsonResponse(http.StatusOK, docs), nil
 }
 
-func handlePost(ctx context.Context, body string) (events.APIGatewayProxyResponse, error) {
-	var jsonData json.RawMessage
+func handlePost(ctx context.Context, q *data.Queries, body string, opts requestOptions) (events.APIGatewayProxyResponse, error) {
+	var jsonData interface{}
 	if err := json.Unmarshal([]byte(body), &jsonData); err != nil {
 		return errorResponse(http.StatusBadRequest, "Invalid JSON"), nil
 	}
 
-	doc, err := queries.CreateDocument(ctx, sql.NullString{
+	doc, err := q.CreateDocument(ctx, sql.NullString{
 		String: body,
 		Valid:  true,
 	})
@@ -102,320 +339,768 @@ func handlePost(ctx context.Context, body string) (events.APIGatewayProxyRespons
 		return errorResponse(http.StatusInternalServerError, "Failed to create document"), nil
 	}
 
-	return jsonResponse(http.StatusCreated, doc), nil
+	ops, results := diffPatch(nil, jsonData)
+	if err := recordRevision(ctx, q, doc, 1, []byte(body), ops, nil); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to record revision"), nil
+	}
+	return writeResponse(http.StatusCreated, doc, 1, []byte(body), results, opts, doc), nil
 }
 
-func handlePut(ctx context.Context, docID int64, body string) (events.APIGatewayProxyResponse, error) {
-	var jsonData json.RawMessage
+// handleGetRevision returns the document as it was at the given version.
+func handleGetRevision(ctx context.Context, docID int64, versionStr string) (events.APIGatewayProxyResponse, error) {
+	version, err := strconv.ParseInt(versionStr, 10, 64)
+	if err != nil || version < 1 {
+		return errorResponse(http.StatusBadRequest, "Invalid version"), nil
+	}
+
+	rev, err := queries.GetDocumentRevision(ctx, data.GetDocumentRevisionParams{
+		DocumentID: docID,
+		Version:    version,
+	})
+	if err == sql.ErrNoRows {
+		return errorResponse(http.StatusNotFound, "Revision not found"), nil
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch revision"), nil
+	}
+
+	resp := jsonResponse(http.StatusOK, rev.Data)
+	resp.Headers["ETag"] = etag(rev.Version)
+	return resp, nil
+}
+
+// revisionSummary describes one revision in a document's history.
+type revisionSummary struct {
+	Version   int64           `json:"version"`
+	Patch     json.RawMessage `json:"patch"`
+	Inverse   json.RawMessage `json:"inverse,omitempty"`
+	CreatedAt string          `json:"createdAt"`
+}
+
+// handleRevisions lists the revisions of a document, oldest first, with the
+// patch that produced each one. Fetch a revision's content with ?version=.
+// The history of a deleted document is still listed.
+func handleRevisions(ctx context.Context, docID int64) (events.APIGatewayProxyResponse, error) {
+	revs, err := queries.ListDocumentRevisions(ctx, docID)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch revisions"), nil
+	}
+	if len(revs) == 0 {
+		return errorResponse(http.StatusNotFound, "Document not found"), nil
+	}
+
+	summaries := make([]revisionSummary, 0, len(revs))
+	for _, rev := range revs {
+		summary := revisionSummary{
+			Version:   rev.Version,
+			Patch:     json.RawMessage("null"),
+			CreatedAt: rev.CreatedAt,
+		}
+		if rev.Patch.Valid {
+			summary.Patch = json.RawMessage(rev.Patch.String)
+		}
+		if rev.Inverse.Valid {
+			summary.Inverse = json.RawMessage(rev.Inverse.String)
+		}
+		summaries = append(summaries, summary)
+	}
+	return jsonResponse(http.StatusOK, summaries), nil
+}
+
+// handlePut replaces a document. With If-None-Match: * it creates the
+// document under the given id instead, failing if it already exists. An id
+// that belonged to a deleted document answers 409, since the new document's
+// versions would collide with the revisions kept from the old one.
+func handlePut(ctx context.Context, q *data.Queries, docID int64, body string, opts requestOptions) (events.APIGatewayProxyResponse, error) {
+	var jsonData interface{}
 	if err := json.Unmarshal([]byte(body), &jsonData); err != nil {
 		return errorResponse(http.StatusBadRequest, "Invalid JSON"), nil
 	}
 
-	err := queries.UpdateDocument(ctx, data.UpdateDocumentParams{
+	currentDoc, err := q.GetDocumentWithVersion(ctx, docID)
+	if err != nil && err != sql.ErrNoRows {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch document"), nil
+	}
+	exists := err == nil
+	if opts.preconditionFailed(exists, currentDoc.Version) {
+		return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
+	}
+
+	if !exists {
+		if opts.ifNoneMatch == "" || docID <= 0 {
+			return errorResponse(http.StatusNotFound, "Document not found"), nil
+		}
+		revs, err := q.ListDocumentRevisions(ctx, docID)
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to fetch revisions"), nil
+		}
+		if len(revs) > 0 {
+			return errorResponse(http.StatusConflict, fmt.Sprintf("Document %d was deleted and its id cannot be reused", docID)), nil
+		}
+		err = q.CreateDocumentWithID(ctx, data.CreateDocumentWithIDParams{
+			ID:   docID,
+			Data: sql.NullString{String: body, Valid: true},
+		})
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to create document"), nil
+		}
+		ops, results := diffPatch(nil, jsonData)
+		if err := recordRevision(ctx, q, docID, 1, []byte(body), ops, nil); err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to record revision"), nil
+		}
+		return writeResponse(http.StatusCreated, docID, 1, []byte(body), results, opts, map[string]interface{}{
+			"id":   docID,
+			"data": json.RawMessage(body),
+		}), nil
+	}
+
+	var currentData interface{}
+	if err := json.Unmarshal([]byte(currentDoc.Data.String), &currentData); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Invalid current document JSON"), nil
+	}
+
+	updated, err := q.UpdateDocument(ctx, data.UpdateDocumentParams{
 		ID: docID,
 		Data: sql.NullString{
 			String: body,
 			Valid:  true,
 		},
+		Version: currentDoc.Version,
 	})
 	if err != nil {
+		if embedsql.IsConflict(err) {
+			return concurrentUpdateResponse(opts), nil
+		}
 		return errorResponse(http.StatusInternalServerError, "Failed to update document"), nil
 	}
+	if updated == 0 {
+		return concurrentUpdateResponse(opts), nil
+	}
 
-	doc, err := queries.GetDocument(ctx, docID)
+	ops, results := diffPatch(currentData, jsonData)
+	inverse, err := patch.Invert(currentData, ops)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to compute inverse patch"), nil
+	}
+	if err := recordRevision(ctx, q, docID, currentDoc.Version+1, []byte(body), ops, inverse); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to record revision"), nil
+	}
+
+	doc, err := q.GetDocument(ctx, docID)
 	if err != nil {
 		return errorResponse(http.StatusInternalServerError, "Failed to fetch updated document"), nil
 	}
 
-	return jsonResponse(http.StatusOK, doc), nil
+	return writeResponse(http.StatusOK, docID, currentDoc.Version+1, []byte(body), results, opts, doc), nil
 }
 
-func handlePatch(ctx context.Context, docID int64, body, contentType string) (events.APIGatewayProxyResponse, error) {
-	currentDoc, err := queries.GetDocument(ctx, docID)
+// handlePatch applies a JSON Patch or a merge patch, chosen by the request's
+// content type, to the stored document; other content types get 415. Merge patches are turned into the equivalent
+// JSON Patch first so both kinds report the same per-operation results. A
+// JSON Patch written against an older revision (Base-Revision) is rebased
+// over the revisions since; merge patches name no positions and are applied
+// as they are. In dry-run mode the result is returned without being stored.
+func handlePatch(ctx context.Context, q *data.Queries, docID int64, body string, opts requestOptions) (events.APIGatewayProxyResponse, error) {
+	mediaType, ok := patchMediaType(opts.contentType)
+	if !ok {
+		resp := errorResponse(http.StatusUnsupportedMediaType, "Content-Type must be "+jsonPatchType+" or "+mergePatchType)
+		resp.Headers["Accept-Patch"] = jsonPatchType + ", " + mergePatchType
+		return resp, nil
+	}
+
+	currentDoc, err := q.GetDocumentWithVersion(ctx, docID)
 	if err == sql.ErrNoRows {
 		return errorResponse(http.StatusNotFound, "Document not found"), nil
 	}
 	if err != nil {
 		return errorResponse(http.StatusInternalServerError, "Failed to fetch document"), nil
 	}
+	if opts.preconditionFailed(true, currentDoc.Version) {
+		return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
+	}
 
-	var currentData map[string]interface{}
-	if err := json.Unmarshal([]byte(currentDoc.String), &currentData); err != nil {
+	var currentData interface{}
+	if err := json.Unmarshal([]byte(currentDoc.Data.String), &currentData); err != nil {
 		return errorResponse(http.StatusInternalServerError, "Invalid current document JSON"), nil
 	}
 
-	if contentType == "application/json-patch+json" {
-		var patchOps []jsonpatch.Operation
+	var patchOps []patch.Operation
+	if mediaType == jsonPatchType {
 		if err := json.Unmarshal([]byte(body), &patchOps); err != nil {
-			return errorResponse(http.StatusBadRequest, "Invalid JSON Patch"), nil
+			return errorResponse(http.StatusBadRequest, "Invalid JSON Patch: "+err.Error()), nil
 		}
-
-		for _, op := range patchOps {
-			path, pathErr := op.Path()
-			if pathErr != nil {
-				return errorResponse(http.StatusBadRequest, fmt.Sprintf("Invalid path in operation: %v", pathErr)), nil
+		if opts.baseRevision > currentDoc.Version {
+			return errorResponse(http.StatusBadRequest, "Base-Revision is newer than the document"), nil
+		}
+		if opts.baseRevision != 0 && opts.baseRevision < currentDoc.Version {
+			patchOps, err = rebasePatch(ctx, q, docID, opts.baseRevision, currentDoc.Version, patchOps, opts.mode)
+			var rebaseErr *patch.RebaseError
+			var patchErr *patch.Error
+			switch {
+			case errors.As(err, &rebaseErr):
+				return jsonResponse(http.StatusConflict, map[string]interface{}{
+					"error":     "Patch conflicts with changes made since the base revision",
+					"conflicts": rebaseErr.Conflicts,
+				}), nil
+			case errors.As(err, &patchErr):
+				return errorResponse(http.StatusBadRequest, "Patch does not apply to the base revision: "+err.Error()), nil
+			case errors.Is(err, errRebaseHistory):
+				return errorResponse(http.StatusConflict, err.Error()), nil
+			case err != nil:
+				log.Print(err)
+				return errorResponse(http.StatusInternalServerError, "Failed to rebase patch"), nil
 			}
-			pathSegments := strings.Split(strings.TrimPrefix(path, "/"), "/")
-
-			var opErr error
-			switch op.Kind() {
-			case "add":
-				value, valueErr := op.ValueInterface()
-				if valueErr != nil {
-					return errorResponse(http.StatusBadRequest, "Invalid value in add operation"), nil
-				}
-				opErr = handleAdd(currentData, pathSegments, value)
+		}
+	} else {
+		mergedData, err := mergePatch([]byte(currentDoc.Data.String), []byte(body))
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, "Failed to apply merge patch"), nil
+		}
+		var merged interface{}
+		if err := json.Unmarshal(mergedData, &merged); err != nil {
+			return errorResponse(http.StatusBadRequest, "Failed to apply merge patch"), nil
+		}
+		patchOps, err = patch.Diff(currentData, merged)
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to apply merge patch"), nil
+		}
+	}
 
-			case "remove":
-				opErr = handleRemove(currentData, pathSegments)
+	patchedData, results, err := patch.ApplyWithResults(currentData, patchOps, patch.WithMode(opts.mode))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+	inverse, err := patch.Invert(currentData, patchOps, patch.WithMode(opts.mode))
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to compute inverse patch"), nil
+	}
 
-			case "replace":
-				value, valueErr := op.ValueInterface()
-				if valueErr != nil {
-					return errorResponse(http.StatusBadRequest, "Invalid value in replace operation"), nil
-				}
-				opErr = handleReplace(currentData, pathSegments, value)
+	jsonData, err := json.Marshal(patchedData)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to marshal JSON"), nil
+	}
 
-			case "move":
-				from, fromErr := getFromPath(op)
-				if fromErr != nil {
-					return errorResponse(http.StatusBadRequest, "Invalid from path in move operation"), nil
-				}
-				fromSegments := strings.Split(strings.TrimPrefix(from, "/"), "/")
-				opErr = handleMove(currentData, fromSegments, pathSegments)
+	if opts.dryRun {
+		return jsonResponse(http.StatusOK, map[string]interface{}{
+			"id":      docID,
+			"data":    json.RawMessage(jsonData),
+			"applied": results,
+			"dryRun":  true,
+		}), nil
+	}
+	return saveDocument(ctx, q, docID, currentDoc.Version, jsonData, patchOps, inverse, results, opts)
+}
 
-			case "copy":
-				from, fromErr := getFromPath(op)
-				if fromErr != nil {
-					return errorResponse(http.StatusBadRequest, "Invalid from path in copy operation"), nil
-				}
-				fromSegments := strings.Split(strings.TrimPrefix(from, "/"), "/")
-				opErr = handleCopy(currentData, fromSegments, pathSegments)
+// The patch formats handlePatch accepts.
+const (
+	jsonPatchType  = "application/json-patch+json"
+	mergePatchType = "application/merge-patch+json"
+)
 
-			case "test":
-				value, valueErr := op.ValueInterface()
-				if valueErr != nil {
-					return errorResponse(http.StatusBadRequest, "Invalid value in test operation"), nil
-				}
-				opErr = handleTest(currentData, pathSegments, value)
-				log.Printf("currentData: %v | opErr: %v", currentData, opErr)
+// patchMediaType returns the patch format named by a Content-Type header,
+// ignoring case and parameters such as charset. It reports false for
+// anything but jsonPatchType and mergePatchType.
+func patchMediaType(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != jsonPatchType && mediaType != mergePatchType) {
+		return "", false
+	}
+	return mediaType, true
+}
+
+// maxBatchItems caps the number of patches in one batch request.
+const maxBatchItems = 100
+
+// batchItem is one entry of a batch request: a patch for a single document.
+// ContentType defaults to JSON Patch for arrays and merge patch otherwise.
+// IfMatch and BaseRevision stand in for the If-Match and Base-Revision
+// headers of a single PATCH.
+type batchItem struct {
+	ID           int64           `json:"id"`
+	ContentType  string          `json:"contentType"`
+	Patch        json.RawMessage `json:"patch"`
+	IfMatch      string          `json:"ifMatch,omitempty"`
+	BaseRevision int64           `json:"baseRevision,omitempty"`
+}
+
+// batchItemResult reports the outcome of one batch entry with the status and
+// body handlePatch produced for it. Status 424 marks entries that were not
+// attempted because an earlier entry failed.
+type batchItemResult struct {
+	Index  int             `json:"index"`
+	ID     int64           `json:"id"`
+	Status int             `json:"status"`
+	ETag   string          `json:"etag,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// handleBatch applies a list of patches to many documents in one
+// transaction, running each through handlePatch. By default the batch is
+// all-or-nothing: the first failing entry rolls everything back and the
+// response takes its status. With continueOnError each entry runs in its own
+// savepoint, so a failing entry is undone on its own and the rest commit.
+func handleBatch(ctx context.Context, q *data.Queries, tx *sql.Tx, body string, continueOnError bool, opts requestOptions) (events.APIGatewayProxyResponse, error) {
+	var items []batchItem
+	if err := json.Unmarshal([]byte(body), &items); err != nil {
+		return errorResponse(http.StatusBadRequest, "Batch must be a JSON array of {id, contentType, patch}"), nil
+	}
+	if len(items) > maxBatchItems {
+		return errorResponse(http.StatusBadRequest, fmt.Sprintf("Batch has %d entries, the limit is %d", len(items), maxBatchItems)), nil
+	}
+	for i, item := range items {
+		if item.ID <= 0 || item.Patch == nil {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("Batch entry %d needs an id and a patch", i)), nil
+		}
+	}
+
+	status := http.StatusOK
+	results := make([]batchItemResult, 0, len(items))
+	for i, item := range items {
+		if status != http.StatusOK {
+			results = append(results, batchItemResult{Index: i, ID: item.ID, Status: http.StatusFailedDependency})
+			continue
+		}
+
+		itemOpts := opts
+		itemOpts.contentType = item.ContentType
+		if itemOpts.contentType == "" {
+			itemOpts.contentType = mergePatchType
+			if strings.HasPrefix(strings.TrimSpace(string(item.Patch)), "[") {
+				itemOpts.contentType = jsonPatchType
 			}
-			log.Printf("opErr: %v", opErr)
-			if opErr != nil {
-				log.Printf("opErr inside: %v", opErr.Error())
-				return errorResponse(http.StatusBadRequest, opErr.Error()), nil
+		}
+		itemOpts.ifMatch = item.IfMatch
+		itemOpts.ifNoneMatch = ""
+		itemOpts.baseRevision = item.BaseRevision
+
+		mark := pendingMark(ctx)
+		if continueOnError {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+				return errorResponse(http.StatusInternalServerError, "Failed to create savepoint"), nil
 			}
 		}
-		jsonData, err := json.Marshal(currentData)
+
+		resp, err := handlePatch(ctx, q, item.ID, string(item.Patch), itemOpts)
 		if err != nil {
-			return errorResponse(http.StatusInternalServerError, "Failed to marshal JSON"), nil
+			return events.APIGatewayProxyResponse{}, err
 		}
-		return handleMergePatch(ctx, docID, string(jsonData), data.Document{
-			ID:   docID,
-			Data: sql.NullString{String: string(jsonData), Valid: true},
-		})
-	} else {
-		return handleMergePatch(ctx, docID, body, data.Document{
-			ID:   docID,
-			Data: sql.NullString{String: currentDoc.String, Valid: true},
-		})
-	}
-}
+		result := batchItemResult{Index: i, ID: item.ID, Status: resp.StatusCode, ETag: resp.Headers["ETag"]}
+		if resp.Body != "" {
+			result.Body = json.RawMessage(resp.Body)
+		}
+		results = append(results, result)
 
-func handleAdd(data map[string]interface{}, path []string, value interface{}) error {
-	if len(path) == 0 {
-		return fmt.Errorf("invalid path: empty")
+		if continueOnError {
+			if resp.StatusCode >= http.StatusBadRequest {
+				if _, err := tx.ExecContext(ctx, "ROLLBACK TO batch_item"); err != nil {
+					return errorResponse(http.StatusInternalServerError, "Failed to roll back batch entry"), nil
+				}
+				discardPending(ctx, mark)
+			}
+			if _, err := tx.ExecContext(ctx, "RELEASE batch_item"); err != nil {
+				return errorResponse(http.StatusInternalServerError, "Failed to release savepoint"), nil
+			}
+		} else if resp.StatusCode >= http.StatusBadRequest {
+			status = resp.StatusCode
+		}
 	}
 
-	if len(path) > 1 {
-		return setNestedValue(data, path, value)
+	out := map[string]interface{}{
+		"committed": status == http.StatusOK && !opts.dryRun,
+		"results":   results,
 	}
-
-	data[path[0]] = value
-	return nil
+	if opts.dryRun {
+		out["dryRun"] = true
+	}
+	return jsonResponse(status, out), nil
 }
 
-func handleRemove(data map[string]interface{}, path []string) error {
-	if len(path) == 0 {
-		return fmt.Errorf("invalid path: empty")
+// errRebaseHistory is wrapped by the rebasePatch errors caused by the
+// revisions recorded since the base, rather than by the database.
+var errRebaseHistory = errors.New("cannot rebase")
+
+// rebasePatch transforms ops, written against revision base of a document,
+// over the patches of the revisions recorded since, so that they apply to
+// the current version.
+func rebasePatch(ctx context.Context, q *data.Queries, docID, base, current int64, ops []patch.Operation, mode patch.Mode) ([]patch.Operation, error) {
+	revs, err := q.ListDocumentRevisions(ctx, docID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch revisions: %w", err)
 	}
 
-	if len(path) > 1 {
-		return removeNestedValue(data, path)
+	var baseData interface{}
+	haveBase := false
+	var over []patch.Operation
+	next := base + 1
+	for _, rev := range revs {
+		switch {
+		case rev.Version == base:
+			if err := json.Unmarshal([]byte(rev.Data.String), &baseData); err != nil {
+				return nil, fmt.Errorf("revision %d has invalid JSON", rev.Version)
+			}
+			haveBase = true
+		case rev.Version == next:
+			var ops []patch.Operation
+			if err := json.Unmarshal([]byte(rev.Patch.String), &ops); err != nil || !rev.Patch.Valid {
+				return nil, fmt.Errorf("%w over revision %d: it has no usable patch", errRebaseHistory, rev.Version)
+			}
+			over = append(over, ops...)
+			next++
+		}
+	}
+	if !haveBase || next != current+1 {
+		return nil, fmt.Errorf("%w from revision %d: the revision history since is incomplete", errRebaseHistory, base)
 	}
 
-	delete(data, path[0])
-	return nil
+	return patch.Rebase(baseData, ops, over, patch.WithMode(mode))
 }
 
-func handleReplace(data map[string]interface{}, path []string, value interface{}) error {
-	if len(path) == 0 {
-		return fmt.Errorf("invalid path: empty")
+// handleRevert rolls a document back to an earlier revision by applying the
+// inverse patches of the revisions after it, newest first. The target is
+// ?version=K, or ?steps=N revisions back from the current one (default 1).
+// The revert is stored as a new revision, so it can itself be reverted.
+func handleRevert(ctx context.Context, q *data.Queries, docID int64, params map[string]string, opts requestOptions) (events.APIGatewayProxyResponse, error) {
+	currentDoc, err := q.GetDocumentWithVersion(ctx, docID)
+	if err == sql.ErrNoRows {
+		return errorResponse(http.StatusNotFound, "Document not found"), nil
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch document"), nil
+	}
+	if opts.preconditionFailed(true, currentDoc.Version) {
+		return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
 	}
 
-	if !pathExists(data, path) {
-		return fmt.Errorf("path does not exist: %s", strings.Join(path, "/"))
+	var target int64
+	if versionStr := params["version"]; versionStr != "" {
+		target, err = strconv.ParseInt(versionStr, 10, 64)
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid version"), nil
+		}
+	} else {
+		steps := int64(1)
+		if stepsStr := params["steps"]; stepsStr != "" {
+			steps, err = strconv.ParseInt(stepsStr, 10, 64)
+			if err != nil || steps < 1 {
+				return errorResponse(http.StatusBadRequest, "Invalid steps"), nil
+			}
+		}
+		target = currentDoc.Version - steps
+	}
+	if target < 1 || target >= currentDoc.Version {
+		return errorResponse(http.StatusBadRequest, fmt.Sprintf("Cannot revert version %d to version %d", currentDoc.Version, target)), nil
 	}
 
-	if len(path) > 1 {
-		return setNestedValue(data, path, value)
+	revs, err := q.ListDocumentRevisions(ctx, docID)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch revisions"), nil
+	}
+	if len(revs) == 0 || revs[len(revs)-1].Version != currentDoc.Version {
+		return errorResponse(http.StatusConflict, "Revision history does not match the current document"), nil
 	}
 
-	data[path[0]] = value
-	return nil
-}
+	revertOps := []patch.Operation{}
+	i := len(revs) - 1
+	for ; i >= 0 && revs[i].Version > target; i-- {
+		inverse, err := revisionInverse(revs, i)
+		if err != nil {
+			return errorResponse(http.StatusConflict, err.Error()), nil
+		}
+		revertOps = append(revertOps, inverse...)
+	}
+	if i < 0 || revs[i].Version != target {
+		return errorResponse(http.StatusNotFound, "Revision not found"), nil
+	}
 
-func handleMove(data map[string]interface{}, from, to []string) error {
-	value, err := getNestedValue(data, from)
+	var currentData interface{}
+	if err := json.Unmarshal([]byte(currentDoc.Data.String), &currentData); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Invalid current document JSON"), nil
+	}
+	revertedData, results, err := patch.ApplyWithResults(currentData, revertOps)
 	if err != nil {
-		return fmt.Errorf("move source not found: %s", strings.Join(from, "/"))
+		return errorResponse(http.StatusConflict, "Revert does not apply: "+err.Error()), nil
+	}
+	inverse, err := patch.Invert(currentData, revertOps)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to compute inverse patch"), nil
 	}
 
-	if err := handleRemove(data, from); err != nil {
-		return err
+	jsonData, err := json.Marshal(revertedData)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to marshal JSON"), nil
 	}
 
-	return handleAdd(data, to, value)
+	if opts.dryRun {
+		return jsonResponse(http.StatusOK, map[string]interface{}{
+			"id":      docID,
+			"data":    json.RawMessage(jsonData),
+			"applied": results,
+			"dryRun":  true,
+		}), nil
+	}
+	return saveDocument(ctx, q, docID, currentDoc.Version, jsonData, revertOps, inverse, results, opts)
 }
 
-func handleCopy(data map[string]interface{}, from, to []string) error {
-	value, err := getNestedValue(data, from)
-	if err != nil {
-		return fmt.Errorf("copy source not found: %s", strings.Join(from, "/"))
+// revisionInverse returns the patch that takes revs[i] back to the revision
+// before it. Revisions recorded without an inverse fall back to diffing the
+// stored bodies of the two revisions.
+func revisionInverse(revs []data.DocumentRevision, i int) ([]patch.Operation, error) {
+	rev := revs[i]
+	if rev.Inverse.Valid {
+		var inverse []patch.Operation
+		if err := json.Unmarshal([]byte(rev.Inverse.String), &inverse); err != nil {
+			return nil, fmt.Errorf("revision %d has an invalid inverse patch", rev.Version)
+		}
+		return inverse, nil
 	}
 
-	copiedValue := deepCopy(value)
-
-	return handleAdd(data, to, copiedValue)
+	if i == 0 || revs[i-1].Version != rev.Version-1 {
+		return nil, fmt.Errorf("revision %d cannot be reverted: the revision before it is not recorded", rev.Version)
+	}
+	var from, to interface{}
+	if err := json.Unmarshal([]byte(rev.Data.String), &from); err != nil {
+		return nil, fmt.Errorf("revision %d has invalid JSON", rev.Version)
+	}
+	if err := json.Unmarshal([]byte(revs[i-1].Data.String), &to); err != nil {
+		return nil, fmt.Errorf("revision %d has invalid JSON", revs[i-1].Version)
+	}
+	return patch.Diff(from, to)
 }
 
-func handleTest(data map[string]interface{}, path []string, value interface{}) error {
-	log.Printf("Data: %v Path: %v", data, path)
-	currentValue, err := getNestedValue(data, path)
-	log.Printf("Current Value: %v | Error: %v", currentValue, err)
-	if err != nil {
-		return fmt.Errorf("test path not found: %s", strings.Join(path, "/"))
+// handleDiff returns the JSON Patch that turns one document into another.
+// With an id the body is compared against the stored document, otherwise the
+// body must be {"from": ..., "to": ...}. Set moves=true or copies=true to
+// detect move and copy operations.
+func handleDiff(ctx context.Context, docID int64, body string, params map[string]string) (events.APIGatewayProxyResponse, error) {
+	var from, to interface{}
+	if docID != 0 {
+		currentDoc, err := queries.GetDocument(ctx, docID)
+		if err == sql.ErrNoRows {
+			return errorResponse(http.StatusNotFound, "Document not found"), nil
+		}
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to fetch document"), nil
+		}
+		if err := json.Unmarshal([]byte(currentDoc.String), &from); err != nil {
+			return errorResponse(http.StatusInternalServerError, "Invalid current document JSON"), nil
+		}
+		if err := json.Unmarshal([]byte(body), &to); err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid JSON"), nil
+		}
+	} else {
+		var pair struct {
+			From json.RawMessage `json:"from"`
+			To   json.RawMessage `json:"to"`
+		}
+		if err := json.Unmarshal([]byte(body), &pair); err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid JSON"), nil
+		}
+		if pair.From == nil || pair.To == nil {
+			return errorResponse(http.StatusBadRequest, "Body must contain from and to"), nil
+		}
+		json.Unmarshal(pair.From, &from)
+		json.Unmarshal(pair.To, &to)
 	}
 
-	if !reflect.DeepEqual(currentValue, value) {
-		return fmt.Errorf("test failed: values do not match at path %s", strings.Join(path, "/"))
+	var opts []patch.DiffOption
+	if params["moves"] == "true" {
+		opts = append(opts, patch.DetectMoves())
+	}
+	if params["copies"] == "true" {
+		opts = append(opts, patch.DetectCopies())
 	}
-	return nil
-}
 
-func getFromPath(op jsonpatch.Operation) (string, error) {
-	from, err := op.From()
+	ops, err := patch.Diff(from, to, opts...)
 	if err != nil {
-		return "", err
+		return errorResponse(http.StatusInternalServerError, "Failed to diff documents"), nil
 	}
-	return from, nil
+
+	resp := jsonResponse(http.StatusOK, ops)
+	resp.Headers["Content-Type"] = jsonPatchType
+	return resp, nil
 }
 
-func setNestedValue(data map[string]interface{}, path []string, value interface{}) error {
-	current := data
-	for i := 0; i < len(path)-1; i++ {
-		key := path[i]
-		if _, ok := current[key]; !ok {
-			current[key] = make(map[string]interface{})
-		}
-		if next, ok := current[key].(map[string]interface{}); ok {
-			current = next
-		} else {
-			return fmt.Errorf("invalid path: %s is not an object", strings.Join(path[:i+1], "/"))
-		}
+// mergePatch applies an RFC 7386 merge patch to any JSON document. A patch
+// that is not an object replaces the document outright, and a document that
+// is not an object is treated as {} before merging.
+func mergePatch(doc, patch []byte) ([]byte, error) {
+	var patchValue interface{}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return nil, err
 	}
-	current[path[len(path)-1]] = value
-	return nil
+	if _, ok := patchValue.(map[string]interface{}); !ok {
+		return json.Marshal(patchValue)
+	}
+
+	var docValue interface{}
+	if err := json.Unmarshal(doc, &docValue); err != nil {
+		return nil, err
+	}
+	if _, ok := docValue.(map[string]interface{}); !ok {
+		doc = []byte("{}")
+	}
+
+	return jsonpatch.MergePatch(doc, patch)
 }
 
-func removeNestedValue(data map[string]interface{}, path []string) error {
-	current := data
-	for i := 0; i < len(path)-1; i++ {
-		next, ok := current[path[i]].(map[string]interface{})
-		if !ok {
-			return fmt.Errorf("path not found: %s", strings.Join(path[:i+1], "/"))
+// saveDocument stores patched as the new document body exactly as given,
+// records ops and their inverse as the patch that produced it, and echoes it
+// back. The write only succeeds if the document is still at version.
+func saveDocument(ctx context.Context, q *data.Queries, docID, version int64, patched []byte, ops, inverse []patch.Operation, results []patch.Result, opts requestOptions) (events.APIGatewayProxyResponse, error) {
+	updated, err := q.UpdateDocument(ctx, data.UpdateDocumentParams{
+		ID: docID,
+		Data: sql.NullString{
+			String: string(patched),
+			Valid:  true,
+		},
+		Version: version,
+	})
+	if err != nil {
+		if embedsql.IsConflict(err) {
+			return concurrentUpdateResponse(opts), nil
 		}
-		current = next
+		return errorResponse(http.StatusInternalServerError, "Failed to update document"), nil
 	}
-	delete(current, path[len(path)-1])
-	return nil
+	if updated == 0 {
+		return concurrentUpdateResponse(opts), nil
+	}
+	if err := recordRevision(ctx, q, docID, version+1, patched, ops, inverse); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to record revision"), nil
+	}
+
+	return writeResponse(http.StatusOK, docID, version+1, patched, results, opts, map[string]interface{}{
+		"id":   docID,
+		"data": json.RawMessage(patched),
+	}), nil
 }
 
-func getNestedValue(data map[string]interface{}, path []string) (interface{}, error) {
-	current := data
-	log.Printf("current: %v", current)
-	for i := 0; i < len(path)-1; i++ {
-		next, ok := current[path[i]].(map[string]interface{})
-		log.Printf("next: %v, ok: %v", next, ok)
-		if !ok {
-			return nil, fmt.Errorf("path not found: %s", strings.Join(path[:i+1], "/"))
+// writeResponse builds the response to a successful write according to the
+// Prefer return preference. return=minimal gives an empty 204,
+// return=representation the stored document, return=patch-result the
+// per-operation results, and no preference the handler's defaultBody. Every
+// variant carries the document's ETag and Location.
+func writeResponse(status int, docID, version int64, stored []byte, results []patch.Result, opts requestOptions, defaultBody interface{}) events.APIGatewayProxyResponse {
+	var resp events.APIGatewayProxyResponse
+	switch opts.returnPref {
+	case "minimal":
+		resp = events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNoContent,
+			Headers:    map[string]string{},
 		}
-		current = next
+	case "representation":
+		resp = jsonResponse(status, map[string]interface{}{
+			"id":   docID,
+			"data": json.RawMessage(stored),
+		})
+	case "patch-result":
+		resp = jsonResponse(status, map[string]interface{}{
+			"id":      docID,
+			"applied": results,
+		})
+	default:
+		resp = jsonResponse(status, defaultBody)
 	}
-	value, exists := current[path[len(path)-1]]
-	log.Printf("value: %v, exists: %v", value, exists)
-	if !exists {
-		return nil, fmt.Errorf("path not found: %s", strings.Join(path, "/"))
+
+	if opts.returnPref != "" {
+		resp.Headers["Preference-Applied"] = "return=" + opts.returnPref
 	}
-	return value, nil
+	resp.Headers["ETag"] = etag(version)
+	resp.Headers["Location"] = fmt.Sprintf("%s?id=%d", opts.location, docID)
+	return resp
 }
 
-func pathExists(data map[string]interface{}, path []string) bool {
-	_, err := getNestedValue(data, path)
-	return err == nil
+// etag formats a document version as an entity tag.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
 }
 
-func deepCopy(value interface{}) interface{} {
-	if value == nil {
-		return nil
-	}
-
-	switch v := value.(type) {
-	case map[string]interface{}:
-		newMap := make(map[string]interface{})
-		for k, v := range v {
-			newMap[k] = deepCopy(v)
+// etagListContains reports whether a comma-separated If-Match or
+// If-None-Match value lists tag. If-Match compares strongly, so a weak
+// W/ tag never matches, while If-None-Match compares weakly (RFC 9110
+// section 13.1).
+func etagListContains(list, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
 		}
-		return newMap
-	case []interface{}:
-		newSlice := make([]interface{}, len(v))
-		for i, v := range v {
-			newSlice[i] = deepCopy(v)
+		if candidate == tag {
+			return true
 		}
-		return newSlice
-	default:
-		return v
 	}
+	return false
 }
 
-func handleMergePatch(ctx context.Context, docID int64, body string, currentDoc data.Document) (events.APIGatewayProxyResponse, error) {
-	mergedData, err := jsonpatch.MergePatch([]byte(currentDoc.Data.String), []byte(body))
+// diffPatch returns the JSON Patch from one document to another along with
+// the results of applying it.
+func diffPatch(from, to interface{}) ([]patch.Operation, []patch.Result) {
+	ops, err := patch.Diff(from, to)
 	if err != nil {
-		return errorResponse(http.StatusBadRequest, "Failed to apply merge patch"), nil
+		return nil, nil
 	}
+	_, results, _ := patch.ApplyWithResults(from, ops)
+	return ops, results
+}
 
-	err = queries.UpdateDocument(ctx, data.UpdateDocumentParams{
-		ID: docID,
-		Data: sql.NullString{
-			String: string(mergedData),
-			Valid:  true,
-		},
+// recordRevision stores the document body at version together with the
+// patch that produced it and, unless the revision created the document, the
+// inverse patch that undoes it, and queues the change for the change feed.
+func recordRevision(ctx context.Context, q *data.Queries, docID, version int64, stored []byte, ops, inverse []patch.Operation) error {
+	patchJSON, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	var inverseJSON sql.NullString
+	if inverse != nil {
+		b, err := json.Marshal(inverse)
+		if err != nil {
+			return err
+		}
+		inverseJSON = sql.NullString{String: string(b), Valid: true}
+	}
+	revID, err := q.CreateDocumentRevision(ctx, data.CreateDocumentRevisionParams{
+		DocumentID: docID,
+		Version:    version,
+		Data:       sql.NullString{String: string(stored), Valid: true},
+		Patch:      sql.NullString{String: string(patchJSON), Valid: true},
+		Inverse:    inverseJSON,
 	})
 	if err != nil {
-		return errorResponse(http.StatusInternalServerError, "Failed to update document"), nil
+		return err
 	}
 
-	return jsonResponse(http.StatusOK, map[string]interface{}{
-		"id":   docID,
-		"data": json.RawMessage(mergedData),
-	}), nil
+	notify(ctx, changeEvent{
+		ID:         revID,
+		Type:       "patch",
+		DocumentID: docID,
+		Version:    version,
+		Patch:      patchJSON,
+	})
+	return nil
 }
 
-func handleDelete(ctx context.Context, docID int64) (events.APIGatewayProxyResponse, error) {
-	err := queries.DeleteDocument(ctx, docID)
+// handleDelete deletes a document. Its revisions are kept, so the history
+// and the change feed still cover it, and its id is not reused: handlePut
+// refuses to create a document under it again.
+func handleDelete(ctx context.Context, q *data.Queries, docID int64, opts requestOptions) (events.APIGatewayProxyResponse, error) {
+	if opts.ifMatch != "" {
+		currentDoc, err := q.GetDocumentWithVersion(ctx, docID)
+		if err != nil && err != sql.ErrNoRows {
+			return errorResponse(http.StatusInternalServerError, "Failed to fetch document"), nil
+		}
+		if opts.preconditionFailed(err == nil, currentDoc.Version) {
+			return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
+		}
+	}
+
+	deleted, err := q.DeleteDocument(ctx, docID)
 	if err != nil {
 		return errorResponse(http.StatusInternalServerError, "Failed to delete document"), nil
 	}
+	if deleted == 0 {
+		return errorResponse(http.StatusNotFound, "Document not found"), nil
+	}
+	notify(ctx, changeEvent{Type: "delete", DocumentID: docID})
 
 	return jsonResponse(http.StatusOK, map[string]string{"message": "Document deleted"}), nil
 }
@@ -435,6 +1120,34 @@ func errorResponse(statusCode int, message string) events.APIGatewayProxyRespons
 	return jsonResponse(statusCode, map[string]string{"error": message})
 }
 
+// patchMode reads the JSON Patch mode from the mode query parameter or the
+// X-Patch-Mode header. Strict is the default.
+func patchMode(req events.APIGatewayProxyRequest) (patch.Mode, error) {
+	mode := req.QueryStringParameters["mode"]
+	if mode == "" {
+		mode = getHeader(req.Headers, "X-Patch-Mode")
+	}
+	return patch.ParseMode(mode)
+}
+
+// preferences parses the Prefer header (RFC 7240) into preference names and
+// values. Preferences without a value map to "".
+func preferences(headers map[string]string) map[string]string {
+	prefs := make(map[string]string)
+	for _, part := range strings.Split(getHeader(headers, "Prefer"), ",") {
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			part = part[:i]
+		}
+		name, value, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefs[name] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return prefs
+}
+
 func getHeader(headers map[string]string, key string) string {
 	if val, ok := headers[key]; ok {
 		return val
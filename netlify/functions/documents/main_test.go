@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+	"github.com/mr-destructive/dummy-json-patch/patch"
+)
+
+const testSecret = "test-secret"
+
+// newTestDB points the function at an empty SQLite database file, which the
+// libsql driver opens through the sqlite3 driver.
+func newTestDB(t *testing.T) {
+	t.Helper()
+	t.Setenv("DB_URL", "file:"+filepath.Join(t.TempDir(), "documents.db"))
+	t.Setenv("JWT_SECRET", testSecret)
+	db, err := openDB(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+// testUsers numbers the users userToken creates.
+var testUsers int
+
+// userToken creates a user holding roles and returns an access token for it.
+func userToken(t *testing.T, roles ...string) string {
+	t.Helper()
+	ctx := context.Background()
+	db, err := openDB(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testUsers++
+	email := fmt.Sprintf("user%d@example.com", testUsers)
+	user, err := queries.CreateUser(ctx, data.CreateUserParams{Name: "Test", Email: email, PasswordHash: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, role := range roles {
+		if err := queries.CreateRole(ctx, role); err != nil {
+			t.Fatal(err)
+		}
+		if err := queries.AddUserRole(ctx, data.AddUserRoleParams{UserID: user.ID, Position: int64(i), Name: role}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := auth.NewAccessToken([]byte(testSecret), user.ID, email, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// request sends a request to the function, with token as its bearer token
+// unless it is empty.
+func request(t *testing.T, method, token, body string, query, headers map[string]string) events.APIGatewayProxyResponse {
+	t.Helper()
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	resp, err := handler(events.APIGatewayProxyRequest{
+		HTTPMethod:            method,
+		Path:                  "/.netlify/functions/documents",
+		Body:                  body,
+		QueryStringParameters: query,
+		Headers:               headers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// createDocument stores body as a new document and returns its id.
+func createDocument(t *testing.T, token, body string) int64 {
+	t.Helper()
+	resp := request(t, "POST", token, body, nil, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %d %s", resp.StatusCode, resp.Body)
+	}
+	var id int64
+	if err := json.Unmarshal([]byte(resp.Body), &id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// storedDocument reads a document straight from the database.
+func storedDocument(t *testing.T, id int64) interface{} {
+	t.Helper()
+	ctx := context.Background()
+	db, err := openDB(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	doc, err := queries.GetDocumentWithVersion(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc.Data.String), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestPatchContentType(t *testing.T) {
+	newTestDB(t)
+	token := userToken(t, auth.RoleEditor)
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		expected    string
+	}{
+		{
+			name:        "JSON Patch with a charset",
+			contentType: "application/json-patch+json; charset=utf-8",
+			body:        `[{"op":"replace","path":"/a","value":2}]`,
+			status:      http.StatusOK,
+			expected:    `{"a":2,"b":[1]}`,
+		},
+		{
+			name:        "JSON Patch in another case",
+			contentType: "Application/JSON-Patch+JSON",
+			body:        `[{"op":"add","path":"/b/-","value":2}]`,
+			status:      http.StatusOK,
+			expected:    `{"a":1,"b":[1,2]}`,
+		},
+		{
+			name:        "merge patch",
+			contentType: "application/merge-patch+json; charset=utf-8",
+			body:        `{"a":null}`,
+			status:      http.StatusOK,
+			expected:    `{"b":[1]}`,
+		},
+		{
+			name:        "plain JSON",
+			contentType: "application/json",
+			body:        `[{"op":"replace","path":"/a","value":2}]`,
+			status:      http.StatusUnsupportedMediaType,
+			expected:    `{"a":1,"b":[1]}`,
+		},
+		{
+			name:     "no content type",
+			body:     `[{"op":"replace","path":"/a","value":2}]`,
+			status:   http.StatusUnsupportedMediaType,
+			expected: `{"a":1,"b":[1]}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			id := createDocument(t, token, `{"a":1,"b":[1]}`)
+			headers := map[string]string{}
+			if c.contentType != "" {
+				headers["Content-Type"] = c.contentType
+			}
+			resp := request(t, "PATCH", token, c.body, map[string]string{"id": strconv.FormatInt(id, 10)}, headers)
+			if resp.StatusCode != c.status {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, c.status)
+			}
+			if c.status == http.StatusUnsupportedMediaType && resp.Headers["Accept-Patch"] == "" {
+				t.Error("415 without Accept-Patch")
+			}
+
+			var expected interface{}
+			if err := json.Unmarshal([]byte(c.expected), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if got := storedDocument(t, id); !reflect.DeepEqual(got, expected) {
+				t.Errorf("stored %v, want %v", got, expected)
+			}
+		})
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifMatch     string
+		ifNoneMatch string
+		exists      bool
+		want        bool
+	}{
+		{"no conditions", "", "", true, false},
+		{"no conditions, missing", "", "", false, false},
+		{"if-match current", `"3"`, "", true, false},
+		{"if-match in list", `"1", "3"`, "", true, false},
+		{"if-match stale", `"2"`, "", true, true},
+		{"if-match weak tag", `W/"3"`, "", true, true},
+		{"if-match any", "*", "", true, false},
+		{"if-match any, missing", "*", "", false, true},
+		{"if-match, missing", `"3"`, "", false, true},
+		{"if-none-match any", "", "*", true, true},
+		{"if-none-match any, missing", "", "*", false, false},
+		{"if-none-match current", "", `"3"`, true, true},
+		{"if-none-match weak current", "", `W/"3"`, true, true},
+		{"if-none-match stale", "", `"2", W/"1"`, true, false},
+	}
+	for _, tt := range tests {
+		opts := requestOptions{ifMatch: tt.ifMatch, ifNoneMatch: tt.ifNoneMatch}
+		if got := opts.preconditionFailed(tt.exists, 3); got != tt.want {
+			t.Errorf("%s: preconditionFailed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	tests := []struct {
+		prefer string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"return=minimal", map[string]string{"return": "minimal"}},
+		{`Return="representation"`, map[string]string{"return": "representation"}},
+		{"return=patch-result; charset=utf-8, dry-run", map[string]string{"return": "patch-result", "dry-run": ""}},
+		{" respond-async , wait=10", map[string]string{"respond-async": "", "wait": "10"}},
+		{",,", map[string]string{}},
+	}
+	for _, tt := range tests {
+		got := preferences(map[string]string{"prefer": tt.prefer})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("preferences(%q) = %v, want %v", tt.prefer, got, tt.want)
+		}
+	}
+
+	opts, err := requestOptionsFrom(events.APIGatewayProxyRequest{Headers: map[string]string{"Prefer": "return=everything"}})
+	if err != nil || opts.returnPref != "" {
+		t.Errorf("an unknown return preference gave %q, %v", opts.returnPref, err)
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	stored := []byte(`{"a":1}`)
+	results := []patch.Result{{Index: 0, Op: "replace", Path: "/a", Changed: []string{"/a"}}}
+	defaultBody := map[string]interface{}{"message": "updated"}
+	tests := []struct {
+		returnPref string
+		status     int
+		body       string
+		applied    string
+	}{
+		{"", http.StatusOK, `{"message":"updated"}`, ""},
+		{"minimal", http.StatusNoContent, "", "return=minimal"},
+		{"representation", http.StatusOK, `{"data":{"a":1},"id":7}`, "return=representation"},
+		{"patch-result", http.StatusOK, `{"applied":[{"index":0,"op":"replace","path":"/a","changed":["/a"]}],"id":7}`, "return=patch-result"},
+	}
+	for _, tt := range tests {
+		opts := requestOptions{returnPref: tt.returnPref, location: "/documents"}
+		resp := writeResponse(http.StatusOK, 7, 4, stored, results, opts, defaultBody)
+		if resp.StatusCode != tt.status || resp.Body != tt.body {
+			t.Errorf("return=%q: %d %s, want %d %s", tt.returnPref, resp.StatusCode, resp.Body, tt.status, tt.body)
+		}
+		if got := resp.Headers["Preference-Applied"]; got != tt.applied {
+			t.Errorf("return=%q: Preference-Applied %q, want %q", tt.returnPref, got, tt.applied)
+		}
+		if resp.Headers["ETag"] != `"4"` || resp.Headers["Location"] != "/documents?id=7" {
+			t.Errorf("return=%q: headers %v", tt.returnPref, resp.Headers)
+		}
+	}
+}
+
+// batchResponse is the body of a batch request.
+type batchResponse struct {
+	Committed bool              `json:"committed"`
+	Results   []batchItemResult `json:"results"`
+}
+
+func TestBatch(t *testing.T) {
+	newTestDB(t)
+	token := userToken(t, auth.RoleEditor)
+
+	// batch sends items as a batch and decodes the response.
+	batch := func(t *testing.T, items []map[string]interface{}, continueOnError bool) (int, batchResponse) {
+		t.Helper()
+		body, err := json.Marshal(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := map[string]string{"action": "batch"}
+		if continueOnError {
+			query["continueOnError"] = "true"
+		}
+		resp := request(t, "POST", token, string(body), query, nil)
+		var out batchResponse
+		if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+			t.Fatalf("%d %s: %v", resp.StatusCode, resp.Body, err)
+		}
+		return resp.StatusCode, out
+	}
+	statuses := func(out batchResponse) []int {
+		var s []int
+		for _, r := range out.Results {
+			s = append(s, r.Status)
+		}
+		return s
+	}
+	expectStored := func(t *testing.T, id int64, expected string) {
+		t.Helper()
+		var v interface{}
+		if err := json.Unmarshal([]byte(expected), &v); err != nil {
+			t.Fatal(err)
+		}
+		if got := storedDocument(t, id); !reflect.DeepEqual(got, v) {
+			t.Errorf("document %d is %v, want %s", id, got, expected)
+		}
+	}
+
+	// items patches three documents; the second patch fails its test op.
+	// The first is inferred to be a JSON Patch and the last a merge patch.
+	items := func(a, b, c int64) []map[string]interface{} {
+		return []map[string]interface{}{
+			{"id": a, "patch": json.RawMessage(`[{"op":"replace","path":"/v","value":2}]`)},
+			{"id": b, "patch": json.RawMessage(`[{"op":"test","path":"/v","value":9},{"op":"replace","path":"/v","value":2}]`)},
+			{"id": c, "patch": json.RawMessage(`{"v":2}`)},
+		}
+	}
+
+	t.Run("all or nothing", func(t *testing.T) {
+		a, b, c := createDocument(t, token, `{"v":1}`), createDocument(t, token, `{"v":1}`), createDocument(t, token, `{"v":1}`)
+		status, out := batch(t, items(a, b, c), false)
+		got := statuses(out)
+		if len(got) != 3 || got[0] != http.StatusOK || got[1] < http.StatusBadRequest || got[2] != http.StatusFailedDependency {
+			t.Fatalf("statuses %v", got)
+		}
+		if status != got[1] || out.Committed {
+			t.Errorf("batch answered %d, committed %v; want the failing entry's %d", status, out.Committed, got[1])
+		}
+		for _, id := range []int64{a, b, c} {
+			expectStored(t, id, `{"v":1}`)
+		}
+	})
+
+	t.Run("continue on error", func(t *testing.T) {
+		a, b, c := createDocument(t, token, `{"v":1}`), createDocument(t, token, `{"v":1}`), createDocument(t, token, `{"v":1}`)
+		status, out := batch(t, items(a, b, c), true)
+		got := statuses(out)
+		if status != http.StatusOK || !out.Committed {
+			t.Fatalf("batch answered %d, committed %v", status, out.Committed)
+		}
+		if len(got) != 3 || got[0] != http.StatusOK || got[1] < http.StatusBadRequest || got[1] == http.StatusFailedDependency || got[2] != http.StatusOK {
+			t.Fatalf("statuses %v", got)
+		}
+		expectStored(t, a, `{"v":2}`)
+		expectStored(t, b, `{"v":1}`)
+		expectStored(t, c, `{"v":2}`)
+	})
+
+	t.Run("explicit content types", func(t *testing.T) {
+		a, b := createDocument(t, token, `{"v":1}`), createDocument(t, token, `{"v":1}`)
+		status, out := batch(t, []map[string]interface{}{
+			{"id": a, "contentType": "application/json-patch+json; charset=utf-8", "patch": json.RawMessage(`[{"op":"remove","path":"/v"}]`)},
+			{"id": b, "contentType": "text/plain", "patch": json.RawMessage(`{"v":2}`)},
+		}, true)
+		if got := statuses(out); status != http.StatusOK || len(got) != 2 || got[0] != http.StatusOK || got[1] != http.StatusUnsupportedMediaType {
+			t.Fatalf("batch answered %d with statuses %v", status, got)
+		}
+		expectStored(t, a, `{}`)
+		expectStored(t, b, `{"v":1}`)
+	})
+
+	t.Run("too many entries", func(t *testing.T) {
+		id := createDocument(t, token, `{"v":1}`)
+		var many []map[string]interface{}
+		for i := 0; i <= maxBatchItems; i++ {
+			many = append(many, map[string]interface{}{"id": id, "patch": json.RawMessage(`{"v":2}`)})
+		}
+		if status, _ := batch(t, many, false); status != http.StatusBadRequest {
+			t.Errorf("a batch of %d entries answered %d", len(many), status)
+		}
+		if status, _ := batch(t, many[:maxBatchItems], false); status != http.StatusOK {
+			t.Errorf("a batch of %d entries answered %d", maxBatchItems, status)
+		}
+	})
+}
+
+func TestDeleteKeepsHistory(t *testing.T) {
+	newTestDB(t)
+	token := userToken(t, auth.RoleEditor)
+	id := createDocument(t, token, `{"v":1}`)
+	query := map[string]string{"id": strconv.FormatInt(id, 10)}
+	jsonPatch := map[string]string{"Content-Type": jsonPatchType}
+
+	if resp := request(t, "PATCH", token, `[{"op":"replace","path":"/v","value":2}]`, query, jsonPatch); resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch: %d %s", resp.StatusCode, resp.Body)
+	}
+	if resp := request(t, "DELETE", token, "", query, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	resp := request(t, "GET", "", "", map[string]string{"id": query["id"], "action": "revisions"}, nil)
+	var revs []revisionSummary
+	if err := json.Unmarshal([]byte(resp.Body), &revs); err != nil || resp.StatusCode != http.StatusOK || len(revs) != 2 {
+		t.Fatalf("revisions after delete: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	create := map[string]string{"If-None-Match": "*"}
+	if resp := request(t, "PUT", token, `{"v":"new"}`, query, create); resp.StatusCode != http.StatusConflict {
+		t.Errorf("re-creating a deleted id: %d %s, want 409", resp.StatusCode, resp.Body)
+	}
+	fresh := map[string]string{"id": strconv.FormatInt(id+100, 10)}
+	if resp := request(t, "PUT", token, `{"v":"new"}`, fresh, create); resp.StatusCode != http.StatusCreated {
+		t.Errorf("creating an unused id: %d %s, want 201", resp.StatusCode, resp.Body)
+	}
+
+	base := map[string]string{"Content-Type": jsonPatchType, "Base-Revision": "1"}
+	if resp := request(t, "PATCH", token, `[{"op":"replace","path":"/v","value":3}]`, query, base); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("patching a deleted document against an old revision: %d %s, want 404", resp.StatusCode, resp.Body)
+	}
+}
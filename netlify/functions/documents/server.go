@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+)
+
+// serve runs the function as a standalone HTTP server on addr, for local
+// development and for the change feed. Requests are translated into API
+// Gateway events and go through route like they do on Lambda, except
+// GET ?action=events, which streams Server-Sent Events and so needs the
+// long-lived connection only a server can hold.
+func serve(addr string) error {
+	db, err := openDB(context.Background())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		req, err := proxyRequest(r)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodGet && r.URL.Query().Get("action") == "events" {
+			if _, denied := authorize(r.Context(), req, auth.ReadDocuments); denied != nil {
+				writeProxyResponse(w, *denied)
+				return
+			}
+			serveEvents(w, r)
+			return
+		}
+		resp, err := route(r.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeProxyResponse(w, resp)
+	})
+
+	log.Printf("documents: listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// proxyRequest converts an HTTP request into the API Gateway event Lambda
+// would deliver for it.
+func proxyRequest(r *http.Request) (events.APIGatewayProxyRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	req := events.APIGatewayProxyRequest{
+		HTTPMethod:                      r.Method,
+		Path:                            r.URL.Path,
+		Headers:                         make(map[string]string, len(r.Header)),
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           make(map[string]string),
+		MultiValueQueryStringParameters: r.URL.Query(),
+		Body:                            string(body),
+	}
+	for name, values := range r.Header {
+		req.Headers[name] = strings.Join(values, ", ")
+	}
+	for name, values := range r.URL.Query() {
+		req.QueryStringParameters[name] = values[len(values)-1]
+	}
+	return req, nil
+}
+
+func writeProxyResponse(w http.ResponseWriter, resp events.APIGatewayProxyResponse) {
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range resp.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if resp.IsBase64Encoded {
+		body, err := base64.StdEncoding.DecodeString(resp.Body)
+		if err != nil {
+			log.Printf("documents: bad base64 response body: %v", err)
+			return
+		}
+		w.Write(body)
+		return
+	}
+	io.WriteString(w, resp.Body)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "github.com/mr-destructive/dummy-json-patch/webhook"
+
+// hooks sends queued webhook deliveries. openDB sets it up.
+var hooks *webhook.Dispatcher
+
+// webhookEvents converts change feed events into webhook events. A change
+// that produced the first version of a document is reported as a create.
+func webhookEvents(changes []changeEvent) []webhook.Event {
+	events := make([]webhook.Event, 0, len(changes))
+	for _, ch := range changes {
+		eventType := webhook.DocumentUpdated
+		switch {
+		case ch.Type == "delete":
+			eventType = webhook.DocumentDeleted
+		case ch.Version == 1:
+			eventType = webhook.DocumentCreated
+		}
+		events = append(events, webhook.NewEvent(eventType, ch.DocumentID, ch.Version, ch.Patch))
+	}
+	return events
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/mr-destructive/dummy-json-patch/audit"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// timestampLayout is how SQLite's CURRENT_TIMESTAMP formats times, used for
+// the times stored alongside it.
+const timestampLayout = "2006-01-02 15:04:05"
+
+// dummyHash is compared against when a login names an unknown email, so
+// that it takes as long as a wrong password and does not reveal which
+// emails have accounts.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+type loginPayload struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type refreshPayload struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// tokenResponse is the body of a successful login or refresh.
+type tokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// handleLogin checks an email and password and issues an access token and
+// a refresh token.
+func handleLogin(ctx context.Context, q *data.Queries, body string) (events.APIGatewayProxyResponse, error) {
+	var payload loginPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+	if payload.Email == "" || payload.Password == "" {
+		return errorResponse(http.StatusBadRequest, "email and password are required"), nil
+	}
+
+	creds, err := q.GetUserCredentials(ctx, payload.Email)
+	if err != nil && err != sql.ErrNoRows {
+		return errorResponse(http.StatusInternalServerError, "Failed to look up user"), nil
+	}
+	hash := []byte(creds.PasswordHash)
+	if err == sql.ErrNoRows {
+		hash = dummyHash()
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(payload.Password)) != nil || err == sql.ErrNoRows {
+		return errorResponse(http.StatusUnauthorized, "Invalid email or password"), nil
+	}
+
+	return issueTokens(ctx, q, creds.ID, creds.Email)
+}
+
+// handleRefresh exchanges a refresh token for a new access token. Refresh
+// tokens are single use: the one presented is revoked and a new one issued
+// in its place.
+func handleRefresh(ctx context.Context, q *data.Queries, body string) (events.APIGatewayProxyResponse, error) {
+	var payload refreshPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil || payload.RefreshToken == "" {
+		return errorResponse(http.StatusBadRequest, "refreshToken is required"), nil
+	}
+
+	hash := auth.HashToken(payload.RefreshToken)
+	stored, err := q.GetRefreshToken(ctx, hash)
+	if err == sql.ErrNoRows {
+		return auth.UnauthorizedResponse("Invalid refresh token", "invalid_token"), nil
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to look up refresh token"), nil
+	}
+	expires, err := time.Parse(timestampLayout, stored.ExpiresAt)
+	if err != nil || stored.RevokedAt.Valid || !time.Now().Before(expires) {
+		return auth.UnauthorizedResponse("Refresh token expired or revoked", "invalid_token"), nil
+	}
+
+	revoked, err := q.RevokeRefreshToken(ctx, hash)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to revoke refresh token"), nil
+	}
+	if revoked == 0 {
+		// Another request redeemed it first.
+		return auth.UnauthorizedResponse("Refresh token expired or revoked", "invalid_token"), nil
+	}
+
+	user, err := q.GetUser(ctx, stored.UserID)
+	if err == sql.ErrNoRows {
+		return auth.UnauthorizedResponse("User no longer exists", "invalid_token"), nil
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch user"), nil
+	}
+	return issueTokens(ctx, q, user.ID, user.Email)
+}
+
+// handleLogout revokes a refresh token. Access tokens stay valid until they
+// expire.
+func handleLogout(ctx context.Context, q *data.Queries, body string) (events.APIGatewayProxyResponse, error) {
+	var payload refreshPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil || payload.RefreshToken == "" {
+		return errorResponse(http.StatusBadRequest, "refreshToken is required"), nil
+	}
+	if _, err := q.RevokeRefreshToken(ctx, auth.HashToken(payload.RefreshToken)); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to revoke refresh token"), nil
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+func issueTokens(ctx context.Context, q *data.Queries, userID int64, email string) (events.APIGatewayProxyResponse, error) {
+	secret, err := auth.Secret()
+	if err != nil {
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Token signing is not configured"), nil
+	}
+	now := time.Now()
+	accessToken, err := auth.NewAccessToken(secret, userID, email, now)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to issue access token"), nil
+	}
+	refreshToken, hash, err := auth.NewToken()
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to issue refresh token"), nil
+	}
+	err = q.CreateRefreshToken(ctx, data.CreateRefreshTokenParams{
+		UserID:    userID,
+		TokenHash: hash,
+		ExpiresAt: now.Add(auth.RefreshTokenTTL).UTC().Format(timestampLayout),
+	})
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to store refresh token"), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "no-store",
+		},
+		Body: jsonify(tokenResponse{
+			AccessToken:  accessToken,
+			TokenType:    "Bearer",
+			ExpiresIn:    int(auth.AccessTokenTTL / time.Second),
+			RefreshToken: refreshToken,
+		}),
+	}, nil
+}
+
+// authenticate verifies the request's bearer token, if it has one, and
+// returns a context carrying its claims and the principal it acts as. A
+// missing token is not an error, since signing up and logging in are open
+// to anyone; a bad one is reported with a 401 response.
+func authenticate(ctx context.Context, q *data.Queries, req events.APIGatewayProxyRequest) (context.Context, *events.APIGatewayProxyResponse) {
+	ctx, err := auth.Load(ctx, q, req)
+	var resp events.APIGatewayProxyResponse
+	switch {
+	case err == nil || errors.Is(err, auth.ErrNoToken):
+		return ctx, nil
+	case auth.Rejected(err):
+		resp = auth.DenyResponse(http.StatusUnauthorized, err, "")
+	default:
+		resp = auth.DenyResponse(http.StatusInternalServerError, err, "")
+	}
+	return ctx, &resp
+}
+
+// denied returns the response for a request whose principal lacks perm:
+// 401 when it is anonymous and 403 otherwise. It returns nil when perm is
+// allowed.
+func denied(ctx context.Context, perm auth.Permission) *events.APIGatewayProxyResponse {
+	principal := auth.PrincipalFrom(ctx)
+	if principal.Can(perm) {
+		return nil
+	}
+	resp := auth.DenyResponse(http.StatusForbidden, auth.ErrForbidden, perm)
+	if principal == nil {
+		resp = auth.DenyResponse(http.StatusUnauthorized, auth.ErrNoToken, perm)
+	}
+	return &resp
+}
+
+// deniedUnlessSelf is denied, except that users may always act on their
+// own account.
+func deniedUnlessSelf(ctx context.Context, userID int64, perm auth.Permission) *events.APIGatewayProxyResponse {
+	if auth.PrincipalFrom(ctx).Is(userID) {
+		return nil
+	}
+	return denied(ctx, perm)
+}
+
+// auditRequest identifies the request for the audit log, with the
+// authenticated user as the actor when there is one.
+func auditRequest(ctx context.Context, req events.APIGatewayProxyRequest) audit.Request {
+	r := audit.FromRequest(req)
+	if claims, ok := auth.ClaimsFrom(ctx); ok {
+		r.Actor = claims.Subject
+	}
+	return r
+}
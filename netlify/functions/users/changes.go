@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/mr-destructive/dummy-json-patch/audit"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+	"github.com/mr-destructive/dummy-json-patch/patch"
+	"github.com/mr-destructive/dummy-json-patch/webhook"
+)
+
+type pendingHooksKey struct{}
+
+// notifyChange queues a change to a user, to be written to the audit log
+// and queued for webhook subscriptions before the request's transaction
+// commits. The change carries the JSON Patch from before to
+// after, the user documents on either side of it; before is nil for a
+// create. Deletes carry no patch.
+func notifyChange(ctx context.Context, eventType string, id, version int64, before, after map[string]interface{}) {
+	pending, ok := ctx.Value(pendingHooksKey{}).(*[]webhook.Event)
+	if !ok {
+		return
+	}
+	var patchJSON json.RawMessage
+	if after != nil {
+		var from interface{}
+		if before != nil {
+			from = before
+		}
+		ops, err := patch.Diff(from, after)
+		if err == nil {
+			patchJSON, _ = json.Marshal(ops)
+		}
+	}
+	*pending = append(*pending, webhook.NewEvent(eventType, id, version, patchJSON))
+}
+
+// recordAudit writes an audit log entry for each change a request made.
+// Updates are recorded as a replace for PUT and a patch otherwise.
+func recordAudit(ctx context.Context, q *data.Queries, method string, changes []webhook.Event) error {
+	for _, ev := range changes {
+		op := audit.Patch
+		switch {
+		case ev.Type == webhook.UserCreated:
+			op = audit.Create
+		case ev.Type == webhook.UserDeleted:
+			op = audit.Delete
+		case method == "PUT":
+			op = audit.Replace
+		}
+		if err := audit.Record(ctx, q, audit.User, ev.ResourceID, op, ev.Patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
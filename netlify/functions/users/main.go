@@ -4,35 +4,46 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/mr-destructive/dummy-json-patch/audit"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	"github.com/mr-destructive/dummy-json-patch/capture"
 	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
 	"github.com/mr-destructive/dummy-json-patch/embedsql"
+	"github.com/mr-destructive/dummy-json-patch/mailer"
+	"github.com/mr-destructive/dummy-json-patch/patch"
+	"github.com/mr-destructive/dummy-json-patch/webhook"
 	_ "github.com/tursodatabase/libsql-client-go/libsql"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type UserPayload struct {
-	Name     string `json:"name"`
-	Email    string `json:"email"`
-	Bio      string `json:"bio"`
-	Roles    string `json:"roles"`
-	Password string `json:"password"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	Bio      string   `json:"bio"`
+	Roles    roleList `json:"roles"`
+	Password string   `json:"password"`
 }
 
+// UserUpdatePayload is the body of a PUT. Roles is nil when the body leaves
+// roles out, which keeps the user's roles as they are.
 type UserUpdatePayload struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Bio   string `json:"bio"`
-	Roles string `json:"roles"`
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Bio   string    `json:"bio"`
+	Roles *roleList `json:"roles"`
 }
 
 var (
@@ -43,26 +54,108 @@ var (
 var users = make(map[string]data.User)
 
 func main() {
-	lambda.Start(handler)
+	replayFile := flag.String("replay", "", "replay a capture file and report responses that differ")
+	flag.Parse()
+	if *replayFile != "" {
+		diffs, err := capture.ReplayFile(*replayFile, "users", handler, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if diffs > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	h, err := capture.WrapFromEnv("users", handler)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(h)
 }
 
 func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	ctx := context.Background()
-	dbName := os.Getenv("DB_NAME")
-	dbToken := os.Getenv("DB_TOKEN")
+	// DB_URL points the function at another database, such as a local
+	// server to replay captured traffic against.
+	dbString := os.Getenv("DB_URL")
+	if dbString == "" {
+		dbString = fmt.Sprintf("libsql://%s?authToken=%s", os.Getenv("DB_NAME"), os.Getenv("DB_TOKEN"))
+	}
 
 	var err error
-	dbString := fmt.Sprintf("libsql://%s?authToken=%s", dbName, dbToken)
 	db, err = sql.Open("libsql", dbString)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Database connection failed"), nil
 	}
 	defer db.Close()
 
 	queries = data.New(db)
-	if _, err := db.ExecContext(ctx, embedsql.DDL); err != nil {
-		log.Fatal(err)
+	if err := embedsql.Migrate(ctx, db); err != nil {
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Database migration failed"), nil
 	}
+
+	ctx, unauthorized := authenticate(ctx, queries, req)
+	if unauthorized != nil {
+		return *unauthorized, nil
+	}
+
+	if req.HTTPMethod == "GET" {
+		return route(ctx, req, queries, db)
+	}
+
+	// Writes run in a transaction so a read-modify-write cycle either
+	// happens completely or not at all. It commits only when the request
+	// succeeded, together with the audit log entries and queued webhook
+	// deliveries for the change, which are first sent after that along with
+	// any emails the request queued.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		if embedsql.IsConflict(err) {
+			return errorResponse(http.StatusConflict, "Database is busy with a concurrent write, retry the request"), nil
+		}
+		return errorResponse(http.StatusInternalServerError, "Failed to start transaction"), nil
+	}
+	defer tx.Rollback()
+
+	var pending []webhook.Event
+	var mail []mailer.Message
+	txCtx := context.WithValue(ctx, pendingHooksKey{}, &pending)
+	txCtx = context.WithValue(txCtx, pendingMailKey{}, &mail)
+	txCtx = audit.WithRequest(txCtx, auditRequest(ctx, req))
+	txQueries := queries.WithTx(tx)
+	resp, err := route(txCtx, req, txQueries, tx)
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		return resp, err
+	}
+	if err := recordAudit(txCtx, txQueries, req.HTTPMethod, pending); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to write audit log"), nil
+	}
+	if err := webhook.Enqueue(txCtx, txQueries, pending); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to queue webhook deliveries"), nil
+	}
+	if err := tx.Commit(); err != nil {
+		if embedsql.IsConflict(err) {
+			return errorResponse(http.StatusConflict, "Transaction conflicted with a concurrent write, retry the request"), nil
+		}
+		return errorResponse(http.StatusInternalServerError, "Failed to commit transaction"), nil
+	}
+	if err := sendMail(ctx, mail); err != nil {
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Failed to send email"), nil
+	}
+	if len(pending) > 0 {
+		webhook.NewDispatcher(queries).SendAfterCommit(ctx)
+	}
+	return resp, nil
+}
+
+// route dispatches a request on its method. q and dbtx are bound to the
+// request's transaction for writes.
+func route(ctx context.Context, req events.APIGatewayProxyRequest, q *data.Queries, dbtx data.DBTX) (events.APIGatewayProxyResponse, error) {
+	var err error
 	userIdStr := req.QueryStringParameters["id"]
 	var userId int64
 	if userIdStr != "" {
@@ -79,23 +172,55 @@ func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse,
 			if err != nil {
 				log.Fatal(err)
 			}
-			user, err := queries.GetUser(ctx, userId)
+			if resp := deniedUnlessSelf(ctx, userId, auth.ReadUsers); resp != nil {
+				return *resp, nil
+			}
+			user, err := loadUser(ctx, q, userId)
+			if err == sql.ErrNoRows {
+				return errorResponse(http.StatusNotFound, "User not found"), nil
+			}
 			if err != nil {
 				log.Fatal(err)
 			}
+			tag := userETag(user.Version)
+			if ifNoneMatch := getHeader(req.Headers, "If-None-Match"); ifNoneMatch == "*" || etagListContains(ifNoneMatch, tag, true) {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusNotModified,
+					Headers:    map[string]string{"ETag": tag},
+				}, nil
+			}
 			return events.APIGatewayProxyResponse{
 				StatusCode: http.StatusOK,
 				Headers: map[string]string{
 					"Content-Type": "application/json",
+					"ETag":         tag,
 				},
 				Body: string(formatUserResponse(user)),
 			}, nil
 		} else {
-			users, err := queries.ListUsers(ctx)
+			if resp := denied(ctx, auth.ReadUsers); resp != nil {
+				return *resp, nil
+			}
+			users, err := q.ListUsers(ctx)
 			if err != nil {
 				log.Fatal(err)
 			}
-			usersJson, err := json.Marshal(users)
+			assignments, err := q.ListRoleAssignments(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, "Failed to list roles"), nil
+			}
+			roles := make(map[int64][]string)
+			for _, a := range assignments {
+				roles[a.UserID] = append(roles[a.UserID], a.Name)
+			}
+			list := make([]json.RawMessage, len(users))
+			for i, u := range users {
+				list[i] = formatUserResponse(userRecord{
+					GetUserRow: data.GetUserRow{ID: u.ID, Name: u.Name, Email: u.Email, Bio: u.Bio},
+					Roles:      roles[u.ID],
+				})
+			}
+			usersJson, err := json.Marshal(list)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -108,44 +233,82 @@ func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse,
 			}, nil
 		}
 	} else if req.HTTPMethod == "POST" {
+		switch req.QueryStringParameters["action"] {
+		case "login":
+			return handleLogin(ctx, q, req.Body)
+		case "refresh":
+			return handleRefresh(ctx, q, req.Body)
+		case "logout":
+			return handleLogout(ctx, q, req.Body)
+		case "password":
+			return handlePasswordChange(ctx, q, userId, req.Body)
+		case "request-reset":
+			return handleResetRequest(ctx, q, req.Body)
+		case "reset":
+			return handleReset(ctx, q, req.Body)
+		}
 
 		var userPayload UserPayload
 		if err := json.Unmarshal([]byte(req.Body), &userPayload); err != nil {
 			return errorResponse(http.StatusBadRequest, err.Error()), nil
 		}
+		if len(userPayload.Roles) > 0 {
+			// The first user may give themselves roles, so that a new
+			// deployment can get its first admin.
+			existing, err := q.ListUsers(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, "Failed to list users"), nil
+			}
+			if resp := denied(ctx, auth.ManageRoles); resp != nil && len(existing) > 0 {
+				return *resp, nil
+			}
+		}
+
+		if getHeader(req.Headers, "If-None-Match") == "*" {
+			// Users are identified by email on create, so If-None-Match: *
+			// means "only if no user with this email exists yet".
+			_, err := q.GetUserByEmail(ctx, userPayload.Email)
+			if err == nil {
+				return errorResponse(http.StatusPreconditionFailed, "User already exists"), nil
+			}
+			if err != sql.ErrNoRows {
+				return errorResponse(http.StatusInternalServerError, "Failed to look up user"), nil
+			}
+		}
 
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userPayload.Password), bcrypt.DefaultCost)
 		if err != nil {
 			return errorResponse(http.StatusBadRequest, err.Error()), nil
 		}
 
-		user, err := queries.CreateUser(context.Background(), data.CreateUserParams{
+		user, err := q.CreateUser(context.Background(), data.CreateUserParams{
 			Name:  userPayload.Name,
 			Email: userPayload.Email,
 			Bio: sql.NullString{
 				String: userPayload.Bio,
 				Valid:  true,
 			},
-			Roles: sql.NullString{
-				String: userPayload.Roles,
-				Valid:  true,
-			},
 			PasswordHash: string(hashedPassword),
 		})
 		if err != nil {
 			return errorResponse(http.StatusBadRequest, err.Error()), nil
 		}
-		createdUser, err := queries.GetUser(context.Background(), int64(user.ID))
+		if err := setUserRoles(ctx, q, user.ID, userPayload.Roles); err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to assign roles"), nil
+		}
+		createdUser, err := loadUser(ctx, q, int64(user.ID))
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to fetch created user"), nil
+		}
+		notifyChange(ctx, webhook.UserCreated, createdUser.ID, createdUser.Version, nil, userDocument(createdUser))
 
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusOK,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-			Body: string(formatUserResponse(createdUser)),
-		}, nil
+		results := diffResults(nil, userDocument(createdUser))
+		return userWriteResponse(req, http.StatusOK, createdUser, results), nil
 	} else if req.HTTPMethod == "PUT" {
 
+		if resp := deniedUnlessSelf(ctx, userId, auth.WriteUsers); resp != nil {
+			return *resp, nil
+		}
 		var userPayload UserUpdatePayload
 		if err := json.Unmarshal([]byte(req.Body), &userPayload); err != nil {
 			return errorResponse(http.StatusBadRequest, err.Error()), nil
@@ -158,14 +321,23 @@ func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse,
 				String: userPayload.Bio,
 				Valid:  true,
 			},
-			Roles: sql.NullString{
-				String: userPayload.Roles,
-				Valid:  true,
-			},
 		}); err != nil {
 			return errorResponse(http.StatusBadRequest, err.Error()), nil
 		}
-		err := queries.UpdateUser(context.Background(), data.UpdateUserParams{
+		existingUser, err := loadUser(ctx, q, userId)
+		if err != nil {
+			return errorResponse(http.StatusNotFound, "User not found"), nil
+		}
+		if userPreconditionFailed(req, existingUser.Version) {
+			return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
+		}
+		rolesChanged := userPayload.Roles != nil && !slices.Equal(*userPayload.Roles, existingUser.Roles)
+		if rolesChanged {
+			if resp := denied(ctx, auth.ManageRoles); resp != nil {
+				return *resp, nil
+			}
+		}
+		updated, err := q.UpdateUser(context.Background(), data.UpdateUserParams{
 			ID:    userId,
 			Name:  userPayload.Name,
 			Email: userPayload.Email,
@@ -173,129 +345,118 @@ func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse,
 				String: userPayload.Bio,
 				Valid:  true,
 			},
-			Roles: sql.NullString{
-				String: userPayload.Roles,
-				Valid:  true,
-			},
+			Version: existingUser.Version,
 		})
+		if err != nil && embedsql.IsConflict(err) {
+			return userConflictResponse(req), nil
+		}
 		if err != nil {
 			return errorResponse(http.StatusBadRequest, err.Error()), nil
 		}
-		updatedUser, err := queries.GetUser(context.Background(), userId)
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusOK,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-			Body: string(formatUserResponse(updatedUser)),
-		}, nil
+		if updated == 0 {
+			return userConflictResponse(req), nil
+		}
+		if rolesChanged {
+			if err := setUserRoles(ctx, q, userId, *userPayload.Roles); err != nil {
+				return errorResponse(http.StatusInternalServerError, "Failed to assign roles"), nil
+			}
+		}
+		updatedUser, err := loadUser(ctx, q, userId)
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to fetch updated user"), nil
+		}
+		notifyChange(ctx, webhook.UserUpdated, userId, updatedUser.Version, userDocument(existingUser), userDocument(updatedUser))
+		results := diffResults(userDocument(existingUser), userDocument(updatedUser))
+		return userWriteResponse(req, http.StatusOK, updatedUser, results), nil
 
 	} else if req.HTTPMethod == "PATCH" {
+		if resp := deniedUnlessSelf(ctx, userId, auth.WriteUsers); resp != nil {
+			return *resp, nil
+		}
 		contentType := getHeader(req.Headers, "Content-Type")
 		log.Printf("Content-Type: %s", contentType)
-		if contentType == "application/json-patch+json" {
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json-patch+json" {
 
-			existingUser, err := queries.GetUser(context.Background(), userId)
+			mode, err := patchMode(req)
+			if err != nil {
+				return errorResponse(http.StatusBadRequest, err.Error()), nil
+			}
+
+			existingUser, err := loadUser(ctx, q, userId)
 			if err != nil {
 				return errorResponse(http.StatusNotFound, "User not found"), nil
 			}
+			if userPreconditionFailed(req, existingUser.Version) {
+				return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
+			}
 
-			var patchOps []jsonpatch.Operation
+			var patchOps []patch.Operation
 			if err := json.Unmarshal([]byte(req.Body), &patchOps); err != nil {
 				return errorResponse(http.StatusBadRequest, "Invalid JSON Patch format"), nil
 			}
 
-			updateParts := make([]string, 0)
-			updateArgs := make([]interface{}, 0)
-
-			allowedPaths := map[string]struct{}{
-				"/name":  {},
-				"/email": {},
-				"/bio":   {},
-				"/roles": {},
+			currentDoc := userDocument(existingUser)
+			patched, results, err := patch.ApplyWithResults(currentDoc, patchOps,
+				patch.WithMode(mode),
+				patch.AllowPaths("/name", "/email", "/bio", "/roles", "/roles/*"),
+			)
+			if err != nil {
+				return errorResponse(http.StatusBadRequest, err.Error()), nil
 			}
-
-			for _, op := range patchOps {
-				if op.Kind() != "replace" {
-					return errorResponse(http.StatusBadRequest,
-						fmt.Sprintf("Operation '%s' not supported. Only 'replace' is allowed", op.Kind())), nil
-				}
-
-				path, err := op.Path()
-				if err != nil {
-					return errorResponse(http.StatusBadRequest, "Invalid path in patch operation"), nil
-				}
-
-				if _, ok := allowedPaths[path]; !ok {
-					return errorResponse(http.StatusBadRequest,
-						fmt.Sprintf("Path '%s' is not allowed", path)), nil
-				}
-
-				value, err := op.ValueInterface()
-				if err != nil {
-					return errorResponse(http.StatusBadRequest, "Invalid value in patch operation"), nil
+			patchedDoc := patched.(map[string]interface{})
+			roles, err := documentRoles(patchedDoc)
+			if err != nil {
+				return errorResponse(http.StatusBadRequest, err.Error()), nil
+			}
+			rolesChanged := !slices.Equal(roles, existingUser.Roles)
+			if rolesChanged {
+				if resp := denied(ctx, auth.ManageRoles); resp != nil {
+					return *resp, nil
 				}
+			}
 
-				switch path {
-				case "/name":
-					strValue, ok := value.(string)
-					if !ok || strValue == "" {
-						return errorResponse(http.StatusBadRequest, "Name must be a non-empty string"), nil
-					}
-					updateParts = append(updateParts, "name = ?")
-					updateArgs = append(updateArgs, strValue)
-
-				case "/email":
-					strValue, ok := value.(string)
-					if !ok || strValue == "" {
-						return errorResponse(http.StatusBadRequest, "Invalid email format"), nil
-					}
-					updateParts = append(updateParts, "email = ?")
-					updateArgs = append(updateArgs, strValue)
-
-				case "/bio":
-					strValue, ok := value.(string)
-					if !ok || strValue == "" {
-						return errorResponse(http.StatusBadRequest, "Bio must be a non-empty string"), nil
-					}
-					updateParts = append(updateParts, "bio = ?")
-					updateArgs = append(updateArgs, strValue)
+			updateParts, updateArgs, err := columnUpdates(currentDoc, patchedDoc)
+			if err != nil {
+				return errorResponse(http.StatusBadRequest, err.Error()), nil
+			}
 
-				case "/roles":
-					strValue, ok := value.(string)
-					if !ok {
-						return errorResponse(http.StatusBadRequest, "Roles must be a string"), nil
-					}
-					updateParts = append(updateParts, "roles = ?")
-					updateArgs = append(updateArgs, sql.NullString{String: strValue, Valid: true})
-				}
+			if isDryRun(req) {
+				return dryRunResponse(previewUser(existingUser, patchedDoc), results), nil
 			}
 
-			if len(updateParts) == 0 {
-				return events.APIGatewayProxyResponse{
-					StatusCode: http.StatusOK,
-					Headers:    map[string]string{"Content-Type": "application/json"},
-					Body:       string(formatUserResponse(existingUser)),
-				}, nil
+			if len(updateParts) == 0 && !rolesChanged {
+				return userWriteResponse(req, http.StatusOK, existingUser, results), nil
 			}
 
-			query := fmt.Sprintf("UPDATE users SET %s WHERE id = ?", strings.Join(updateParts, ", "))
-			updateArgs = append(updateArgs, userId)
+			// The version is bumped even when only the roles changed, so
+			// the user's ETag changes with them.
+			updateParts = append(updateParts, "version = version + 1")
+			query := fmt.Sprintf("UPDATE users SET %s WHERE id = ? AND version = ?", strings.Join(updateParts, ", "))
+			updateArgs = append(updateArgs, userId, existingUser.Version)
 
-			if _, err := db.ExecContext(context.Background(), query, updateArgs...); err != nil {
+			result, err := dbtx.ExecContext(context.Background(), query, updateArgs...)
+			if err != nil && embedsql.IsConflict(err) {
+				return userConflictResponse(req), nil
+			}
+			if err != nil {
 				return errorResponse(http.StatusInternalServerError, "Failed to update user"), nil
 			}
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				return userConflictResponse(req), nil
+			}
+			if rolesChanged {
+				if err := setUserRoles(ctx, q, userId, roles); err != nil {
+					return errorResponse(http.StatusInternalServerError, "Failed to assign roles"), nil
+				}
+			}
 
-			updatedUser, err := queries.GetUser(context.Background(), userId)
+			updatedUser, err := loadUser(ctx, q, userId)
 			if err != nil {
 				return errorResponse(http.StatusInternalServerError, "Failed to fetch updated user"), nil
 			}
+			notifyChange(ctx, webhook.UserUpdated, userId, updatedUser.Version, currentDoc, userDocument(updatedUser))
 
-			return events.APIGatewayProxyResponse{
-				StatusCode: http.StatusOK,
-				Headers:    map[string]string{"Content-Type": "application/json"},
-				Body:       string(formatUserResponse(updatedUser)),
-			}, nil
+			return userWriteResponse(req, http.StatusOK, updatedUser, results), nil
 
 		} else {
 			var updates map[string]interface{}
@@ -310,7 +471,6 @@ func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse,
 				"name":  true,
 				"email": true,
 				"bio":   true,
-				"roles": true,
 			}
 
 			for field, value := range updates {
@@ -321,34 +481,105 @@ func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse,
 				args = append(args, value)
 			}
 
-			if len(updateParts) == 0 {
+			var roles roleList
+			rolesValue, hasRoles := updates["roles"]
+			if hasRoles {
+				raw, _ := json.Marshal(rolesValue)
+				if err := json.Unmarshal(raw, &roles); err != nil {
+					return errorResponse(http.StatusBadRequest, err.Error()), nil
+				}
+			}
+
+			if len(updateParts) == 0 && !hasRoles {
 				return errorResponse(http.StatusBadRequest, "No valid fields to update"), nil
 			}
 
-			query := fmt.Sprintf("UPDATE users SET %s WHERE id = ?", strings.Join(updateParts, ", "))
-			args = append(args, userId)
+			existingUser, err := loadUser(ctx, q, userId)
+			if err != nil {
+				return errorResponse(http.StatusNotFound, "User not found"), nil
+			}
+			if userPreconditionFailed(req, existingUser.Version) {
+				return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
+			}
+			rolesChanged := hasRoles && !slices.Equal(roles, existingUser.Roles)
+			if rolesChanged {
+				if resp := denied(ctx, auth.ManageRoles); resp != nil {
+					return *resp, nil
+				}
+			}
+
+			if isDryRun(req) {
+				currentDoc := userDocument(existingUser)
+				previewDoc := userDocument(existingUser)
+				for field, value := range updates {
+					if allowedColumns[field] {
+						previewDoc[field] = value
+					}
+				}
+				if hasRoles {
+					previewDoc["roles"] = roleValues(roles)
+				}
+				ops, err := patch.Diff(currentDoc, previewDoc)
+				if err != nil {
+					return errorResponse(http.StatusInternalServerError, "Failed to preview update"), nil
+				}
+				_, results, _ := patch.ApplyWithResults(currentDoc, ops)
+				return dryRunResponse(previewUser(existingUser, previewDoc), results), nil
+			}
+
+			updateParts = append(updateParts, "version = version + 1")
+			query := fmt.Sprintf("UPDATE users SET %s WHERE id = ? AND version = ?", strings.Join(updateParts, ", "))
+			args = append(args, userId, existingUser.Version)
 
-			_, err = db.ExecContext(context.Background(), query, args...)
+			result, err := dbtx.ExecContext(context.Background(), query, args...)
+			if err != nil && embedsql.IsConflict(err) {
+				return userConflictResponse(req), nil
+			}
 			if err != nil {
 				return errorResponse(http.StatusInternalServerError, "Failed to update user"), nil
 			}
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				return userConflictResponse(req), nil
+			}
+			if rolesChanged {
+				if err := setUserRoles(ctx, q, userId, roles); err != nil {
+					return errorResponse(http.StatusInternalServerError, "Failed to assign roles"), nil
+				}
+			}
 
-			updatedUser, err := queries.GetUser(context.Background(), userId)
+			updatedUser, err := loadUser(ctx, q, userId)
 			if err != nil {
 				return errorResponse(http.StatusInternalServerError, "Failed to get updated user"), nil
 			}
+			notifyChange(ctx, webhook.UserUpdated, userId, updatedUser.Version, userDocument(existingUser), userDocument(updatedUser))
 
-			return events.APIGatewayProxyResponse{
-				StatusCode: http.StatusOK,
-				Headers: map[string]string{
-					"Content-Type": "application/json",
-				},
-				Body: string(formatUserResponse(updatedUser)),
-			}, nil
+			results := diffResults(userDocument(existingUser), userDocument(updatedUser))
+			return userWriteResponse(req, http.StatusOK, updatedUser, results), nil
 		}
 
 	} else if req.HTTPMethod == "DELETE" {
-		err := queries.DeleteUser(context.Background(), userId)
+		if resp := denied(ctx, auth.WriteUsers); resp != nil {
+			return *resp, nil
+		}
+		if getHeader(req.Headers, "If-Match") != "" {
+			existingUser, err := q.GetUser(context.Background(), userId)
+			if err == sql.ErrNoRows || (err == nil && userPreconditionFailed(req, existingUser.Version)) {
+				return errorResponse(http.StatusPreconditionFailed, "Precondition failed"), nil
+			}
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, "Failed to fetch user"), nil
+			}
+		}
+		deleted, err := q.DeleteUser(context.Background(), userId)
+		if err == nil && deleted == 0 {
+			return errorResponse(http.StatusNotFound, "User not found"), nil
+		}
+		if err == nil {
+			err = q.DeleteUserRoles(ctx, userId)
+		}
+		if err == nil {
+			err = q.RevokeUserRefreshTokens(ctx, userId)
+		}
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: http.StatusInternalServerError,
@@ -358,6 +589,7 @@ func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse,
 				Body: err.Error(),
 			}, nil
 		}
+		notifyChange(ctx, webhook.UserDeleted, userId, 0, nil, nil)
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusOK,
 			Headers: map[string]string{
@@ -390,7 +622,7 @@ func errorResponse(statusCode int, message string) events.APIGatewayProxyRespons
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 		},
-		Body: fmt.Sprintf(`{"error": "%s"}`, message),
+		Body: jsonify(map[string]string{"error": message}),
 	}
 }
 
@@ -401,25 +633,263 @@ func validateUserUpdate(user data.UpdateUserParams) error {
 	return nil
 }
 
-func formatUserResponse(user data.GetUserRow) []byte {
+func formatUserResponse(user userRecord) []byte {
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
 	response := struct {
-		ID    int64  `json:"id"`
-		Name  string `json:"name"`
-		Email string `json:"email"`
-		Bio   string `json:"bio"`
-		Roles string `json:"roles"`
+		ID    int64    `json:"id"`
+		Name  string   `json:"name"`
+		Email string   `json:"email"`
+		Bio   string   `json:"bio"`
+		Roles []string `json:"roles"`
 	}{
 		ID:    user.ID,
 		Name:  user.Name,
 		Email: user.Email,
 		Bio:   user.Bio.String,
-		Roles: user.Roles.String,
+		Roles: roles,
 	}
 
 	bytes, _ := json.Marshal(response)
 	return bytes
 }
 
+// patchMode reads the JSON Patch mode from the mode query parameter or the
+// X-Patch-Mode header. Strict is the default.
+func patchMode(req events.APIGatewayProxyRequest) (patch.Mode, error) {
+	mode := req.QueryStringParameters["mode"]
+	if mode == "" {
+		mode = getHeader(req.Headers, "X-Patch-Mode")
+	}
+	return patch.ParseMode(mode)
+}
+
+// userDocument maps the patchable fields of a user to a JSON object. bio
+// is left out when it is NULL, so that "add" sets it and "remove" clears
+// it. roles is an array, so single roles can be added at /roles/- and
+// removed at /roles/N; removing the whole array clears them.
+func userDocument(user userRecord) map[string]interface{} {
+	doc := map[string]interface{}{
+		"name":  user.Name,
+		"email": user.Email,
+		"roles": roleValues(user.Roles),
+	}
+	if user.Bio.Valid {
+		doc["bio"] = user.Bio.String
+	}
+	return doc
+}
+
+// roleValues converts role names to the []interface{} a decoded JSON
+// array is, so user documents compare equal to patched ones.
+func roleValues(roles []string) []interface{} {
+	values := make([]interface{}, len(roles))
+	for i, role := range roles {
+		values[i] = role
+	}
+	return values
+}
+
+// columnUpdates diffs a patched user document against the current one and
+// returns the SET clauses and arguments of the UPDATE that stores it. name
+// and email are required; bio is set to NULL when the patch removed it.
+// roles live in their own table and are read with documentRoles.
+func columnUpdates(current, patched map[string]interface{}) ([]string, []interface{}, error) {
+	for field := range patched {
+		switch field {
+		case "name", "email", "bio", "roles":
+		default:
+			return nil, nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	var parts []string
+	var args []interface{}
+	for _, field := range []string{"name", "email", "bio"} {
+		value, present := patched[field]
+		old, wasPresent := current[field]
+		if present == wasPresent && reflect.DeepEqual(value, old) {
+			continue
+		}
+
+		strValue, isString := value.(string)
+		switch field {
+		case "name":
+			if !isString || strValue == "" {
+				return nil, nil, fmt.Errorf("name must be a non-empty string")
+			}
+			parts = append(parts, "name = ?")
+			args = append(args, strValue)
+
+		case "email":
+			if !isString || !strings.Contains(strValue, "@") {
+				return nil, nil, fmt.Errorf("invalid email format")
+			}
+			parts = append(parts, "email = ?")
+			args = append(args, strValue)
+
+		case "bio":
+			if present && (!isString || strValue == "") {
+				return nil, nil, fmt.Errorf("bio must be a non-empty string; remove it to clear it")
+			}
+			parts = append(parts, "bio = ?")
+			args = append(args, sql.NullString{String: strValue, Valid: present})
+		}
+	}
+	return parts, args, nil
+}
+
+// previewUser returns user with the fields of doc applied, for showing the
+// outcome of an update without writing it. bio missing from doc is
+// previewed as NULL and roles missing from it as none.
+func previewUser(user userRecord, doc map[string]interface{}) userRecord {
+	if name, ok := doc["name"].(string); ok {
+		user.Name = name
+	}
+	if email, ok := doc["email"].(string); ok {
+		user.Email = email
+	}
+	bio, ok := doc["bio"].(string)
+	user.Bio = sql.NullString{String: bio, Valid: ok}
+	if roles, err := documentRoles(doc); err == nil {
+		user.Roles = roles
+	}
+	return user
+}
+
+func dryRunResponse(user userRecord, results []patch.Result) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body: jsonify(map[string]interface{}{
+			"user":    json.RawMessage(formatUserResponse(user)),
+			"applied": results,
+			"dryRun":  true,
+		}),
+	}
+}
+
+// userWriteResponse builds the response to a successful write according to
+// the Prefer return preference: return=minimal gives an empty 204,
+// return=patch-result the per-operation results, and otherwise the user is
+// returned. Every variant carries the user's ETag and Location.
+func userWriteResponse(req events.APIGatewayProxyRequest, status int, user userRecord, results []patch.Result) events.APIGatewayProxyResponse {
+	body := formatUserResponse(user)
+	resp := events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+
+	returnPref := preferences(req.Headers)["return"]
+	switch returnPref {
+	case "minimal":
+		resp.StatusCode = http.StatusNoContent
+		resp.Body = ""
+	case "patch-result":
+		resp.Body = jsonify(map[string]interface{}{
+			"id":      user.ID,
+			"applied": results,
+		})
+	case "representation":
+	default:
+		returnPref = ""
+	}
+
+	if returnPref != "" {
+		resp.Headers["Preference-Applied"] = "return=" + returnPref
+	}
+	resp.Headers["ETag"] = userETag(user.Version)
+	resp.Headers["Location"] = fmt.Sprintf("%s?id=%d", req.Path, user.ID)
+	return resp
+}
+
+// userETag formats a user's version as an entity tag.
+func userETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// userPreconditionFailed evaluates the If-Match and If-None-Match headers of
+// a write against the current version of an existing user.
+func userPreconditionFailed(req events.APIGatewayProxyRequest, version int64) bool {
+	tag := userETag(version)
+	if ifMatch := getHeader(req.Headers, "If-Match"); ifMatch != "" && ifMatch != "*" && !etagListContains(ifMatch, tag, false) {
+		return true
+	}
+	if ifNoneMatch := getHeader(req.Headers, "If-None-Match"); ifNoneMatch == "*" || etagListContains(ifNoneMatch, tag, true) {
+		return true
+	}
+	return false
+}
+
+// userConflictResponse reports an update that lost a race with another
+// writer: 412 when the client made it conditional with If-Match, 409
+// otherwise.
+func userConflictResponse(req events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if getHeader(req.Headers, "If-Match") != "" {
+		return errorResponse(http.StatusPreconditionFailed, "User was modified concurrently")
+	}
+	return errorResponse(http.StatusConflict, "User was modified concurrently, retry the request")
+}
+
+// etagListContains reports whether a comma-separated If-Match or
+// If-None-Match value lists tag. If-Match compares strongly, so a weak
+// W/ tag never matches, while If-None-Match compares weakly (RFC 9110
+// section 13.1).
+func etagListContains(list, tag string, weak bool) bool {
+	if list == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// diffResults describes the change from one document to another as the
+// results of the equivalent JSON Patch.
+func diffResults(from, to interface{}) []patch.Result {
+	ops, err := patch.Diff(from, to)
+	if err != nil {
+		return nil
+	}
+	_, results, _ := patch.ApplyWithResults(from, ops)
+	return results
+}
+
+// isDryRun reports whether the request asked for a preview with
+// ?dryRun=true or "Prefer: dry-run".
+func isDryRun(req events.APIGatewayProxyRequest) bool {
+	_, preferDryRun := preferences(req.Headers)["dry-run"]
+	return req.QueryStringParameters["dryRun"] == "true" || preferDryRun
+}
+
+// preferences parses the Prefer header (RFC 7240) into preference names and
+// values. Preferences without a value map to "".
+func preferences(headers map[string]string) map[string]string {
+	prefs := make(map[string]string)
+	for _, part := range strings.Split(getHeader(headers, "Prefer"), ",") {
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			part = part[:i]
+		}
+		name, value, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefs[name] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return prefs
+}
+
 func getHeader(headers map[string]string, key string) string {
 	if val, ok := headers[key]; ok {
 		return val
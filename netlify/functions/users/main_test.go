@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	"github.com/mr-destructive/dummy-json-patch/patch"
+)
+
+const testSecret = "test-secret"
+
+// newTestDB points the function at an empty SQLite database file, which the
+// libsql driver opens through the sqlite3 driver.
+func newTestDB(t *testing.T) {
+	t.Helper()
+	t.Setenv("DB_URL", "file:"+filepath.Join(t.TempDir(), "users.db"))
+	t.Setenv("JWT_SECRET", testSecret)
+}
+
+// request sends a request to the function, with token as its bearer token
+// unless it is empty.
+func request(t *testing.T, method, token, body string, query map[string]string) events.APIGatewayProxyResponse {
+	t.Helper()
+	headers := map[string]string{}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	resp, err := handler(events.APIGatewayProxyRequest{
+		HTTPMethod:            method,
+		Path:                  "/.netlify/functions/users",
+		Body:                  body,
+		QueryStringParameters: query,
+		Headers:               headers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+type testUser struct {
+	ID    int64    `json:"id"`
+	Name  string   `json:"name"`
+	Email string   `json:"email"`
+	Bio   string   `json:"bio"`
+	Roles []string `json:"roles"`
+}
+
+// createUser creates a user through the function, signed in as token, and
+// returns it with an access token for it.
+func createUser(t *testing.T, token, body string) (testUser, string) {
+	t.Helper()
+	resp := request(t, "POST", token, body, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: %d %s", resp.StatusCode, resp.Body)
+	}
+	var user testUser
+	if err := json.Unmarshal([]byte(resp.Body), &user); err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := auth.NewAccessToken([]byte(testSecret), user.ID, user.Email, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, userToken
+}
+
+func TestPutRoles(t *testing.T) {
+	newTestDB(t)
+	admin, adminToken := createUser(t, "", `{"name":"Admin","email":"admin@example.com","password":"secret123","roles":["admin"]}`)
+	editor, editorToken := createUser(t, adminToken, `{"name":"Ed","email":"ed@example.com","password":"secret123","roles":["editor"]}`)
+
+	cases := []struct {
+		name   string
+		token  string
+		user   testUser
+		body   string
+		status int
+		roles  []string
+	}{
+		{
+			name:   "own profile without roles",
+			token:  editorToken,
+			user:   editor,
+			body:   `{"name":"Edith","email":"ed@example.com","bio":"Writes"}`,
+			status: http.StatusOK,
+			roles:  []string{"editor"},
+		},
+		{
+			name:   "own profile with the same roles",
+			token:  editorToken,
+			user:   editor,
+			body:   `{"name":"Edith","email":"ed@example.com","bio":"Writes","roles":["editor"]}`,
+			status: http.StatusOK,
+			roles:  []string{"editor"},
+		},
+		{
+			name:   "own profile with null roles",
+			token:  editorToken,
+			user:   editor,
+			body:   `{"name":"Edith","email":"ed@example.com","bio":"Writes","roles":null}`,
+			status: http.StatusOK,
+			roles:  []string{"editor"},
+		},
+		{
+			name:   "own roles",
+			token:  editorToken,
+			user:   editor,
+			body:   `{"name":"Edith","email":"ed@example.com","bio":"Writes","roles":["admin"]}`,
+			status: http.StatusForbidden,
+			roles:  []string{"editor"},
+		},
+		{
+			name:   "admin edits a profile without roles",
+			token:  adminToken,
+			user:   editor,
+			body:   `{"name":"Edith","email":"ed@example.com","bio":"Edited"}`,
+			status: http.StatusOK,
+			roles:  []string{"editor"},
+		},
+		{
+			name:   "admin edits own profile without roles",
+			token:  adminToken,
+			user:   admin,
+			body:   `{"name":"Ada","email":"admin@example.com","bio":"Runs things"}`,
+			status: http.StatusOK,
+			roles:  []string{"admin"},
+		},
+		{
+			name:   "admin clears roles",
+			token:  adminToken,
+			user:   editor,
+			body:   `{"name":"Edith","email":"ed@example.com","bio":"Edited","roles":[]}`,
+			status: http.StatusOK,
+			roles:  []string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			id := strconv.FormatInt(c.user.ID, 10)
+			resp := request(t, "PUT", c.token, c.body, map[string]string{"id": id})
+			if resp.StatusCode != c.status {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, c.status)
+			}
+
+			resp = request(t, "GET", c.token, "", map[string]string{"id": id})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("get: %d %s", resp.StatusCode, resp.Body)
+			}
+			var got testUser
+			if err := json.Unmarshal([]byte(resp.Body), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Roles, c.roles) {
+				t.Errorf("roles = %v, want %v", got.Roles, c.roles)
+			}
+		})
+	}
+}
+
+func TestColumnUpdates(t *testing.T) {
+	current := `{"name":"Ada","email":"ada@example.com","bio":"Analyst","roles":["user"]}`
+	cases := []struct {
+		name    string
+		ops     string
+		parts   []string
+		args    []interface{}
+		wantErr bool
+	}{
+		{
+			name:  "bio remove clears it",
+			ops:   `[{"op":"remove","path":"/bio"}]`,
+			parts: []string{"bio = ?"},
+			args:  []interface{}{sql.NullString{}},
+		},
+		{
+			name:  "name and email replaced",
+			ops:   `[{"op":"replace","path":"/name","value":"Grace"},{"op":"replace","path":"/email","value":"grace@example.com"}]`,
+			parts: []string{"name = ?", "email = ?"},
+			args:  []interface{}{"Grace", "grace@example.com"},
+		},
+		{
+			name: "roles only change no column",
+			ops:  `[{"op":"add","path":"/roles/-","value":"admin"}]`,
+		},
+		{
+			name:    "move of name to bio leaves no name",
+			ops:     `[{"op":"move","from":"/name","path":"/bio"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "non-string email",
+			ops:     `[{"op":"replace","path":"/email","value":42}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			ops:     `[{"op":"add","path":"/age","value":36}]`,
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var before, doc map[string]interface{}
+			if err := json.Unmarshal([]byte(current), &before); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(current), &doc); err != nil {
+				t.Fatal(err)
+			}
+			var ops []patch.Operation
+			if err := json.Unmarshal([]byte(c.ops), &ops); err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patch.Apply(doc, ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parts, args, err := columnUpdates(before, patched.(map[string]interface{}))
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("got %v %v, want an error", parts, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parts, c.parts) || !reflect.DeepEqual(args, c.args) {
+				t.Errorf("got %v %#v, want %v %#v", parts, args, c.parts, c.args)
+			}
+		})
+	}
+}
+
+func TestETagListContains(t *testing.T) {
+	tests := []struct {
+		list string
+		weak bool
+		want bool
+	}{
+		{"", true, false},
+		{`"2"`, false, true},
+		{` "1" , "2"`, false, true},
+		{`"1"`, false, false},
+		{`W/"2"`, false, false},
+		{`W/"2"`, true, true},
+		{`"1", W/"2"`, true, true},
+	}
+	for _, tt := range tests {
+		if got := etagListContains(tt.list, `"2"`, tt.weak); got != tt.want {
+			t.Errorf("etagListContains(%q, weak=%v) = %v, want %v", tt.list, tt.weak, got, tt.want)
+		}
+	}
+}
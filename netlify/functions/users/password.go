@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/mr-destructive/dummy-json-patch/audit"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+	"github.com/mr-destructive/dummy-json-patch/mailer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the shortest new password accepted.
+const minPasswordLength = 8
+
+// resetTokenTTL is how long a password reset token can be redeemed.
+const resetTokenTTL = time.Hour
+
+// sender delivers password reset emails. It is nil when MAIL_SENDER does
+// not choose one, and reset requests are then refused.
+var sender = newSender()
+
+func newSender() mailer.Sender {
+	s, err := mailer.FromEnv()
+	if err != nil {
+		log.Printf("password reset emails are disabled: %v", err)
+	}
+	return s
+}
+
+type passwordChangePayload struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type resetRequestPayload struct {
+	Email string `json:"email"`
+}
+
+type resetPayload struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// handlePasswordChange sets a new password for the authenticated user after
+// checking the current one. userID is the ?id the request addressed, or 0
+// for the caller's own account. Refresh tokens issued before the change are
+// revoked.
+func handlePasswordChange(ctx context.Context, q *data.Queries, userID int64, body string) (events.APIGatewayProxyResponse, error) {
+	principal := auth.PrincipalFrom(ctx)
+	if principal == nil {
+		return auth.UnauthorizedResponse("Authentication required", ""), nil
+	}
+	if userID == 0 {
+		userID = principal.UserID
+	}
+	if !principal.Is(userID) {
+		return errorResponse(http.StatusForbidden, "Users can only change their own password"), nil
+	}
+
+	var payload passwordChangePayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+	if err := validatePassword(payload.NewPassword); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+
+	hash, err := q.GetUserPasswordHash(ctx, userID)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch user"), nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(payload.CurrentPassword)) != nil {
+		return errorResponse(http.StatusForbidden, "Current password is incorrect"), nil
+	}
+
+	if resp := setPassword(ctx, q, userID, payload.NewPassword); resp != nil {
+		return *resp, nil
+	}
+	if err := audit.Record(ctx, q, audit.User, userID, audit.PasswordChange, nil); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to write audit log"), nil
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+// handleResetRequest emails a single-use password reset token to the user
+// with the given email. It responds 202 whether or not the email belongs to
+// a user, so it cannot be used to find out which emails have accounts, and
+// 503 when no mail sender is configured.
+func handleResetRequest(ctx context.Context, q *data.Queries, body string) (events.APIGatewayProxyResponse, error) {
+	if sender == nil {
+		return errorResponse(http.StatusServiceUnavailable, "Password reset emails are not configured"), nil
+	}
+	var payload resetRequestPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil || payload.Email == "" {
+		return errorResponse(http.StatusBadRequest, "email is required"), nil
+	}
+	accepted := events.APIGatewayProxyResponse{
+		StatusCode: http.StatusAccepted,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       jsonify(map[string]string{"message": "If the email belongs to an account, a reset link has been sent"}),
+	}
+
+	creds, err := q.GetUserCredentials(ctx, payload.Email)
+	if err == sql.ErrNoRows {
+		return accepted, nil
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to look up user"), nil
+	}
+
+	token, hash, err := auth.NewToken()
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to create reset token"), nil
+	}
+	err = q.CreatePasswordReset(ctx, data.CreatePasswordResetParams{
+		UserID:    creds.ID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(resetTokenTTL).UTC().Format(timestampLayout),
+	})
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to store reset token"), nil
+	}
+
+	queueMail(ctx, resetMessage(creds.Email, token))
+	return accepted, nil
+}
+
+type pendingMailKey struct{}
+
+// queueMail queues a message to be sent once the request's transaction has
+// committed, so an email never refers to a token that was rolled back.
+func queueMail(ctx context.Context, m mailer.Message) {
+	if pending, ok := ctx.Value(pendingMailKey{}).(*[]mailer.Message); ok {
+		*pending = append(*pending, m)
+	}
+}
+
+// sendMail sends the messages a request queued.
+func sendMail(ctx context.Context, messages []mailer.Message) error {
+	for _, m := range messages {
+		if err := sender.Send(ctx, m); err != nil {
+			return fmt.Errorf("sending mail to %s: %w", m.To, err)
+		}
+	}
+	return nil
+}
+
+// resetMessage builds the reset email. RESET_URL, when set, is the page
+// that redeems the token; the token is appended to it as a query parameter.
+func resetMessage(to, token string) mailer.Message {
+	body := fmt.Sprintf("Use this token to reset your password within %s:\n\n%s\n", resetTokenTTL, token)
+	if resetURL := os.Getenv("RESET_URL"); resetURL != "" {
+		sep := "?"
+		if strings.Contains(resetURL, "?") {
+			sep = "&"
+		}
+		body = fmt.Sprintf("Open this link to reset your password within %s:\n\n%s%stoken=%s\n", resetTokenTTL, resetURL, sep, token)
+	}
+	return mailer.Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body:    body + "\nIf you did not ask for a reset, you can ignore this email.\n",
+	}
+}
+
+// handleReset redeems a reset token and sets a new password. The token and
+// any other outstanding reset tokens of the user stop working, and refresh
+// tokens issued before the reset are revoked.
+func handleReset(ctx context.Context, q *data.Queries, body string) (events.APIGatewayProxyResponse, error) {
+	var payload resetPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil || payload.Token == "" {
+		return errorResponse(http.StatusBadRequest, "token is required"), nil
+	}
+	if err := validatePassword(payload.NewPassword); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+
+	hash := auth.HashToken(payload.Token)
+	reset, err := q.GetPasswordReset(ctx, hash)
+	if err == sql.ErrNoRows {
+		return errorResponse(http.StatusBadRequest, "Invalid or expired reset token"), nil
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to look up reset token"), nil
+	}
+	expires, err := time.Parse(timestampLayout, reset.ExpiresAt)
+	if err != nil || reset.UsedAt.Valid || !time.Now().Before(expires) {
+		return errorResponse(http.StatusBadRequest, "Invalid or expired reset token"), nil
+	}
+
+	used, err := q.UsePasswordReset(ctx, hash)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to redeem reset token"), nil
+	}
+	if used == 0 {
+		// Another request redeemed it first.
+		return errorResponse(http.StatusBadRequest, "Invalid or expired reset token"), nil
+	}
+	if err := q.InvalidatePasswordResets(ctx, reset.UserID); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to invalidate reset tokens"), nil
+	}
+
+	if resp := setPassword(ctx, q, reset.UserID, payload.NewPassword); resp != nil {
+		return *resp, nil
+	}
+	if err := audit.Record(ctx, q, audit.User, reset.UserID, audit.PasswordReset, nil); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to write audit log"), nil
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+// setPassword stores a new password hash for a user and revokes their
+// refresh tokens.
+func setPassword(ctx context.Context, q *data.Queries, userID int64, password string) *events.APIGatewayProxyResponse {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		resp := errorResponse(http.StatusBadRequest, err.Error())
+		return &resp
+	}
+	err = q.UpdateUserPassword(ctx, data.UpdateUserPasswordParams{PasswordHash: string(hashed), ID: userID})
+	if err == nil {
+		err = q.RevokeUserRefreshTokens(ctx, userID)
+	}
+	if err != nil {
+		resp := errorResponse(http.StatusInternalServerError, "Failed to update password")
+		return &resp
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("newPassword must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+)
+
+// userRecord is a user together with the roles it holds, in the order they
+// were assigned.
+type userRecord struct {
+	data.GetUserRow
+	Roles []string
+}
+
+// loadUser fetches a user and its roles. It returns sql.ErrNoRows when the
+// user does not exist.
+func loadUser(ctx context.Context, q *data.Queries, id int64) (userRecord, error) {
+	user, err := q.GetUser(ctx, id)
+	if err != nil {
+		return userRecord{}, err
+	}
+	roles, err := q.ListUserRoles(ctx, id)
+	if err != nil {
+		return userRecord{}, err
+	}
+	return userRecord{GetUserRow: user, Roles: roles}, nil
+}
+
+// setUserRoles replaces the roles a user holds, creating roles that do not
+// exist yet.
+func setUserRoles(ctx context.Context, q *data.Queries, userID int64, roles []string) error {
+	if err := q.DeleteUserRoles(ctx, userID); err != nil {
+		return err
+	}
+	for i, name := range roles {
+		if err := q.CreateRole(ctx, name); err != nil {
+			return err
+		}
+		err := q.AddUserRole(ctx, data.AddUserRoleParams{
+			UserID:   userID,
+			Position: int64(i),
+			Name:     name,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roleList is the roles member of a request body. It is a JSON array of
+// role names, or a string of names separated by commas or whitespace as
+// clients sent before roles were a list, and is normalized by
+// auth.NormalizeRoles.
+type roleList []string
+
+func (r *roleList) UnmarshalJSON(b []byte) error {
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		var s string
+		if json.Unmarshal(b, &s) != nil {
+			return fmt.Errorf("roles must be an array of role names")
+		}
+		*r = auth.ParseRoles(s)
+		return nil
+	}
+	*r = auth.NormalizeRoles(names)
+	return nil
+}
+
+// documentRoles reads the roles array of a user document. A document
+// without roles holds none.
+func documentRoles(doc map[string]interface{}) ([]string, error) {
+	value, ok := doc["roles"]
+	if !ok || value == nil {
+		return []string{}, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("roles must be an array of role names")
+	}
+	names := make([]string, len(list))
+	for i, v := range list {
+		name, ok := v.(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("roles must be an array of role names")
+		}
+		names[i] = name
+	}
+	return auth.NormalizeRoles(names), nil
+}
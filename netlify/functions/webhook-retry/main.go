@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+	"github.com/mr-destructive/dummy-json-patch/embedsql"
+	"github.com/mr-destructive/dummy-json-patch/webhook"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+)
+
+// runTimeout bounds a run to well within the function timeout; deliveries
+// left over are sent by the next run.
+const runTimeout = 20 * time.Second
+
+// batchSize is how many due deliveries a run attempts.
+const batchSize = 500
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler runs on the schedule in netlify.toml. It sends the webhook
+// deliveries that the writes queuing them did not get to, and retries
+// failed ones once their backoff has passed.
+func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), runTimeout)
+	defer cancel()
+
+	dbString := os.Getenv("DB_URL")
+	if dbString == "" {
+		dbString = fmt.Sprintf("libsql://%s?authToken=%s", os.Getenv("DB_NAME"), os.Getenv("DB_TOKEN"))
+	}
+	db, err := sql.Open("libsql", dbString)
+	if err != nil {
+		log.Print(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Database connection failed"}), nil
+	}
+	defer db.Close()
+	if err := embedsql.Migrate(ctx, db); err != nil {
+		log.Print(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Database migration failed"}), nil
+	}
+
+	attempted, err := webhook.NewDispatcher(data.New(db)).Send(ctx, batchSize)
+	if err != nil {
+		log.Print(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list due deliveries"}), nil
+	}
+	return jsonResponse(http.StatusOK, map[string]int{"attempted": attempted}), nil
+}
+
+func jsonResponse(statusCode int, data interface{}) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(data)
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
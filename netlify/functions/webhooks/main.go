@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/mr-destructive/dummy-json-patch/auth"
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+	"github.com/mr-destructive/dummy-json-patch/embedsql"
+	"github.com/mr-destructive/dummy-json-patch/webhook"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+)
+
+// defaultDeliveryLimit and maxDeliveryLimit bound how much of the delivery
+// log ?action=deliveries returns.
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+var queries *data.Queries
+
+func main() {
+	lambda.Start(handler)
+}
+
+func handler(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx := context.Background()
+	dbString := os.Getenv("DB_URL")
+	if dbString == "" {
+		dbString = fmt.Sprintf("libsql://%s?authToken=%s", os.Getenv("DB_NAME"), os.Getenv("DB_TOKEN"))
+	}
+	db, err := sql.Open("libsql", dbString)
+	if err != nil {
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Database connection failed"), nil
+	}
+	defer db.Close()
+	if err := embedsql.Migrate(ctx, db); err != nil {
+		log.Print(err)
+		return errorResponse(http.StatusInternalServerError, "Database migration failed"), nil
+	}
+	queries = data.New(db)
+
+	ctx, status, err := auth.Authorize(ctx, queries, req, auth.ManageWebhooks)
+	if err != nil {
+		return auth.DenyResponse(status, err, auth.ManageWebhooks), nil
+	}
+
+	return route(ctx, req)
+}
+
+// route dispatches a request on its method. Subscriptions are created with
+// POST, listed or fetched with GET, and removed with DELETE ?id=N; GET
+// ?id=N&action=deliveries returns a subscription's newest deliveries, with
+// the outcome of their latest attempt.
+func route(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var id int64
+	if idStr := req.QueryStringParameters["id"]; idStr != "" {
+		var err error
+		id, err = strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid webhook ID"), nil
+		}
+	}
+
+	switch req.HTTPMethod {
+	case "GET":
+		if id == 0 {
+			return handleList(ctx)
+		}
+		if req.QueryStringParameters["action"] == "deliveries" {
+			return handleDeliveries(ctx, id, req.QueryStringParameters["limit"])
+		}
+		return handleGet(ctx, id)
+	case "POST":
+		return handleCreate(ctx, req.Body)
+	case "DELETE":
+		return handleDelete(ctx, id)
+	default:
+		return errorResponse(http.StatusMethodNotAllowed, "Method not allowed"), nil
+	}
+}
+
+// webhookPayload is the body of a create request. A subscription without a
+// secret gets a generated one.
+type webhookPayload struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// webhookResponse is a subscription as the API shows it. The secret is only
+// included in the response to the create request.
+type webhookResponse struct {
+	ID        int64    `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+func toResponse(hook data.Webhook) webhookResponse {
+	return webhookResponse{
+		ID:        hook.ID,
+		URL:       hook.Url,
+		Events:    strings.Split(hook.Events, ","),
+		CreatedAt: hook.CreatedAt,
+	}
+}
+
+func handleCreate(ctx context.Context, body string) (events.APIGatewayProxyResponse, error) {
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid JSON"), nil
+	}
+
+	target, err := url.Parse(payload.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errorResponse(http.StatusBadRequest, "url must be an absolute http or https URL"), nil
+	}
+	if len(payload.Events) == 0 {
+		return errorResponse(http.StatusBadRequest, "events must list at least one event type"), nil
+	}
+	for _, t := range payload.Events {
+		if !webhook.ValidEventType(t) {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("Unknown event type %q; use one of %s, document.*, user.* or *", t, strings.Join(webhook.EventTypes, ", "))), nil
+		}
+	}
+	if payload.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return errorResponse(http.StatusInternalServerError, "Failed to generate secret"), nil
+		}
+		payload.Secret = hex.EncodeToString(b)
+	}
+
+	hook, err := queries.CreateWebhook(ctx, data.CreateWebhookParams{
+		Url:    payload.URL,
+		Events: strings.Join(payload.Events, ","),
+		Secret: payload.Secret,
+	})
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to create webhook"), nil
+	}
+
+	resp := toResponse(hook)
+	resp.Secret = hook.Secret
+	return jsonResponse(http.StatusCreated, resp), nil
+}
+
+func handleList(ctx context.Context) (events.APIGatewayProxyResponse, error) {
+	hooks, err := queries.ListWebhooks(ctx)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to list webhooks"), nil
+	}
+	list := make([]webhookResponse, len(hooks))
+	for i, hook := range hooks {
+		list[i] = toResponse(hook)
+	}
+	return jsonResponse(http.StatusOK, list), nil
+}
+
+func handleGet(ctx context.Context, id int64) (events.APIGatewayProxyResponse, error) {
+	hook, err := queries.GetWebhook(ctx, id)
+	if err == sql.ErrNoRows {
+		return errorResponse(http.StatusNotFound, "Webhook not found"), nil
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch webhook"), nil
+	}
+	return jsonResponse(http.StatusOK, toResponse(hook)), nil
+}
+
+// deliveryResponse is one delivery of an event. State is "pending" until it
+// is delivered or has failed for good; Attempt counts the attempts made so
+// far, and StatusCode and Error describe the latest of them.
+type deliveryResponse struct {
+	ID            int64           `json:"id"`
+	EventID       string          `json:"eventId"`
+	EventType     string          `json:"eventType"`
+	State         string          `json:"state"`
+	Attempt       int64           `json:"attempt"`
+	StatusCode    *int64          `json:"statusCode"`
+	Error         string          `json:"error,omitempty"`
+	NextAttemptAt string          `json:"nextAttemptAt,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     string          `json:"createdAt"`
+}
+
+func handleDeliveries(ctx context.Context, id int64, limitStr string) (events.APIGatewayProxyResponse, error) {
+	limit := int64(defaultDeliveryLimit)
+	if limitStr != "" {
+		var err error
+		limit, err = strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit < 1 || limit > maxDeliveryLimit {
+			return errorResponse(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxDeliveryLimit)), nil
+		}
+	}
+
+	if _, err := queries.GetWebhook(ctx, id); err == sql.ErrNoRows {
+		return errorResponse(http.StatusNotFound, "Webhook not found"), nil
+	} else if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch webhook"), nil
+	}
+
+	deliveries, err := queries.ListWebhookDeliveries(ctx, data.ListWebhookDeliveriesParams{
+		WebhookID: id,
+		Limit:     limit,
+	})
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to fetch deliveries"), nil
+	}
+	list := make([]deliveryResponse, len(deliveries))
+	for i, d := range deliveries {
+		list[i] = deliveryResponse{
+			ID:        d.ID,
+			EventID:   d.EventID,
+			EventType: d.EventType,
+			State:     d.State,
+			Attempt:   d.Attempt,
+			Error:     d.Error.String,
+			Payload:   json.RawMessage(d.Payload),
+			CreatedAt: d.CreatedAt,
+		}
+		if d.State == webhook.Pending {
+			list[i].NextAttemptAt = d.NextAttemptAt.String
+		}
+		if d.StatusCode.Valid {
+			status := d.StatusCode.Int64
+			list[i].StatusCode = &status
+		}
+	}
+	return jsonResponse(http.StatusOK, list), nil
+}
+
+func handleDelete(ctx context.Context, id int64) (events.APIGatewayProxyResponse, error) {
+	deleted, err := queries.DeleteWebhook(ctx, id)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to delete webhook"), nil
+	}
+	if deleted == 0 {
+		return errorResponse(http.StatusNotFound, "Webhook not found"), nil
+	}
+	if err := queries.DeleteWebhookDeliveries(ctx, id); err != nil {
+		return errorResponse(http.StatusInternalServerError, "Failed to delete delivery log"), nil
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"message": "Webhook deleted"}), nil
+}
+
+func jsonResponse(statusCode int, data interface{}) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(data)
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
+
+func errorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	return jsonResponse(statusCode, map[string]string{"error": message})
+}
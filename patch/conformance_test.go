@@ -0,0 +1,118 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// knownDeviations lists conformance cases this package is known to get
+// wrong, keyed by "<file>/<comment>", with the reason. A listed case that
+// starts passing fails the run so the entry gets removed.
+var knownDeviations = map[string]string{}
+
+type conformanceCase struct {
+	Comment  string          `json:"comment"`
+	Doc      json.RawMessage `json:"doc"`
+	Patch    json.RawMessage `json:"patch"`
+	Expected json.RawMessage `json:"expected"`
+	Error    string          `json:"error"`
+	Disabled bool            `json:"disabled"`
+}
+
+func TestConformance(t *testing.T) {
+	for _, file := range []string{"tests.json", "spec_tests.json"} {
+		t.Run(file, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cases []conformanceCase
+			if err := json.Unmarshal(raw, &cases); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, c := range cases {
+				name := c.Comment
+				if name == "" {
+					name = fmt.Sprintf("case %d", i)
+				}
+				t.Run(name, func(t *testing.T) {
+					if c.Disabled {
+						t.Skip("disabled upstream")
+					}
+
+					err := runConformanceCase(c)
+					reason, deviates := knownDeviations[file+"/"+c.Comment]
+					switch {
+					case deviates && err == nil:
+						t.Errorf("known deviation (%s) now passes; remove it from knownDeviations", reason)
+					case deviates:
+						t.Skipf("known deviation: %s: %v", reason, err)
+					case err != nil:
+						t.Error(err)
+					}
+				})
+			}
+		})
+	}
+}
+
+func runConformanceCase(c conformanceCase) error {
+	var doc interface{}
+	if err := json.Unmarshal(c.Doc, &doc); err != nil {
+		return fmt.Errorf("bad doc: %v", err)
+	}
+
+	var ops []Operation
+	var result interface{}
+	err := json.Unmarshal(c.Patch, &ops)
+	if err == nil {
+		result, err = Apply(doc, ops)
+	}
+
+	if c.Error != "" {
+		if err == nil {
+			return fmt.Errorf("expected error %q, got result %v", c.Error, result)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unexpected error: %v", err)
+	}
+	if err := checkInverse(doc, ops, result); err != nil {
+		return err
+	}
+	if c.Expected == nil {
+		return nil
+	}
+
+	var expected interface{}
+	if err := json.Unmarshal(c.Expected, &expected); err != nil {
+		return fmt.Errorf("bad expected: %v", err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		return fmt.Errorf("got %v, want %v", result, expected)
+	}
+	return nil
+}
+
+// checkInverse verifies that the inverse of a successful patch takes its
+// result back to the original document.
+func checkInverse(doc interface{}, ops []Operation, result interface{}) error {
+	inverse, err := Invert(doc, ops)
+	if err != nil {
+		return fmt.Errorf("invert: %v", err)
+	}
+	restored, err := Apply(result, inverse)
+	if err != nil {
+		return fmt.Errorf("apply inverse %v: %v", inverse, err)
+	}
+	if !reflect.DeepEqual(restored, doc) {
+		return fmt.Errorf("inverse %v restored %v, want %v", inverse, restored, doc)
+	}
+	return nil
+}
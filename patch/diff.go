@@ -0,0 +1,319 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// DiffOption configures Diff.
+type DiffOption func(*diffOptions)
+
+type diffOptions struct {
+	moves  bool
+	copies bool
+}
+
+// DetectMoves makes Diff turn a removed value that reappears elsewhere into
+// a single move operation.
+func DetectMoves() DiffOption {
+	return func(o *diffOptions) { o.moves = true }
+}
+
+// DetectCopies makes Diff emit copy operations for added objects and arrays
+// that already exist, unchanged, elsewhere in the document.
+func DetectCopies() DiffOption {
+	return func(o *diffOptions) { o.copies = true }
+}
+
+// Diff returns a patch that turns from into to. Both are decoded JSON
+// values. Without options the patch only contains add, remove and replace
+// operations. Move and copy detection is best effort: if the shortened patch
+// does not reproduce to exactly, the plain patch is returned instead.
+func Diff(from, to interface{}, opts ...DiffOption) ([]Operation, error) {
+	var o diffOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	d := differ{ops: []Operation{}}
+	d.diff(Pointer{}, from, to)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if !o.moves && !o.copies {
+		return d.ops, nil
+	}
+
+	ops := d.ops
+	if o.moves {
+		ops = detectMoves(ops, d.removed)
+	}
+	if o.copies {
+		ops = detectCopies(ops, from, to)
+	}
+	if result, err := Apply(from, ops); err != nil || !reflect.DeepEqual(result, to) {
+		return d.ops, nil
+	}
+	return ops, nil
+}
+
+type differ struct {
+	ops []Operation
+	// removed holds the value each remove operation deleted, by op index.
+	removed map[int]interface{}
+	err     error
+}
+
+func (d *differ) diff(path Pointer, a, b interface{}) {
+	if d.err != nil || reflect.DeepEqual(a, b) {
+		return
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			d.diffObjects(path, av, bv)
+			return
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			d.diffArrays(path, av, bv)
+			return
+		}
+	}
+	d.emit("replace", path, b)
+}
+
+func (d *differ) diffObjects(path Pointer, a, b map[string]interface{}) {
+	for _, key := range sortedKeys(a) {
+		if _, ok := b[key]; !ok {
+			d.remove(append(path[:len(path):len(path)], key), a[key])
+		}
+	}
+	for _, key := range sortedKeys(b) {
+		child := append(path[:len(path):len(path)], key)
+		if av, ok := a[key]; ok {
+			d.diff(child, av, b[key])
+		} else {
+			d.emit("add", child, b[key])
+		}
+	}
+}
+
+// maxLCSCells bounds the size of the table used to align array elements.
+// Larger arrays are diffed position by position.
+const maxLCSCells = 1 << 16
+
+// diffArrays trims the common prefix and suffix, aligns the remaining
+// elements on their longest common subsequence, and turns each unaligned
+// stretch into element diffs followed by removals or insertions.
+func (d *differ) diffArrays(path Pointer, a, b []interface{}) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && reflect.DeepEqual(a[prefix], b[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		reflect.DeepEqual(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+
+	midA := a[prefix : len(a)-suffix]
+	midB := b[prefix : len(b)-suffix]
+
+	// Every stretch starts at the index its first element has in b, since
+	// everything before it already matches b.
+	lastA, lastB := 0, 0
+	for _, m := range alignArrays(midA, midB) {
+		d.diffStretch(path, prefix+lastB, midA[lastA:m[0]], midB[lastB:m[1]])
+		lastA, lastB = m[0]+1, m[1]+1
+	}
+	d.diffStretch(path, prefix+lastB, midA[lastA:], midB[lastB:])
+}
+
+func (d *differ) diffStretch(path Pointer, start int, a, b []interface{}) {
+	overlap := len(a)
+	if len(b) < overlap {
+		overlap = len(b)
+	}
+
+	for i := 0; i < overlap; i++ {
+		d.diff(append(path[:len(path):len(path)], strconv.Itoa(start+i)), a[i], b[i])
+	}
+	for i := overlap; i < len(a); i++ {
+		d.remove(append(path[:len(path):len(path)], strconv.Itoa(start+overlap)), a[i])
+	}
+	for i := overlap; i < len(b); i++ {
+		d.emit("add", append(path[:len(path):len(path)], strconv.Itoa(start+i)), b[i])
+	}
+}
+
+// alignArrays returns the index pairs of a longest common subsequence of a
+// and b, or nothing when the arrays are too large to align.
+func alignArrays(a, b []interface{}) [][2]int {
+	if len(a) == 0 || len(b) == 0 || (len(a)+1)*(len(b)+1) > maxLCSCells {
+		return nil
+	}
+
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case reflect.DeepEqual(a[i], b[j]):
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var matches [][2]int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case reflect.DeepEqual(a[i], b[j]):
+			matches = append(matches, [2]int{i, j})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
+
+func (d *differ) remove(path Pointer, old interface{}) {
+	if d.removed == nil {
+		d.removed = make(map[int]interface{})
+	}
+	d.removed[len(d.ops)] = old
+	d.ops = append(d.ops, Operation{Op: "remove", Path: path.String()})
+}
+
+func (d *differ) emit(op string, path Pointer, value interface{}) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		d.err = err
+		return
+	}
+	d.ops = append(d.ops, Operation{Op: op, Path: path.String(), Value: raw})
+}
+
+// detectMoves replaces each add whose value was removed elsewhere by a move
+// from the removed location, dropping the remove.
+func detectMoves(ops []Operation, removed map[int]interface{}) []Operation {
+	used := make(map[int]bool)
+	moved := make(map[int]string)
+	for i, op := range ops {
+		if op.Op != "add" {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			old, ok := removed[j]
+			if !ok || used[j] || !reflect.DeepEqual(old, value) {
+				continue
+			}
+			used[j] = true
+			moved[i] = ops[j].Path
+			break
+		}
+	}
+
+	result := make([]Operation, 0, len(ops))
+	for i, op := range ops {
+		if used[i] {
+			continue
+		}
+		if from, ok := moved[i]; ok {
+			op = Operation{Op: "move", From: from, Path: op.Path}
+		}
+		result = append(result, op)
+	}
+	return result
+}
+
+// detectCopies replaces adds of objects and arrays with copies from a
+// location holding the same value in both documents.
+func detectCopies(ops []Operation, from, to interface{}) []Operation {
+	sources := make(map[string]interface{})
+	collectContainers(Pointer{}, from, sources)
+
+	result := make([]Operation, 0, len(ops))
+	for _, op := range ops {
+		if op.Op == "add" {
+			var value interface{}
+			if err := json.Unmarshal(op.Value, &value); err == nil {
+				if source, ok := findSource(sources, value, to); ok {
+					op = Operation{Op: "copy", From: source, Path: op.Path}
+				}
+			}
+		}
+		result = append(result, op)
+	}
+	return result
+}
+
+func findSource(sources map[string]interface{}, value, to interface{}) (string, bool) {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return "", false
+	}
+
+	paths := make([]string, 0, len(sources))
+	for path := range sources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if !reflect.DeepEqual(sources[path], value) {
+			continue
+		}
+		ptr, _ := ParsePointer(path)
+		if current, err := Get(to, ptr); err == nil && reflect.DeepEqual(current, value) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func collectContainers(path Pointer, value interface{}, out map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) > 0 {
+			out[path.String()] = v
+		}
+		for key, child := range v {
+			collectContainers(append(path[:len(path):len(path)], key), child, out)
+		}
+	case []interface{}:
+		if len(path) > 0 {
+			out[path.String()] = v
+		}
+		for i, child := range v {
+			collectContainers(append(path[:len(path):len(path)], strconv.Itoa(i)), child, out)
+		}
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	cases := []struct {
+		name     string
+		from     string
+		to       string
+		opts     []DiffOption
+		expected string
+	}{
+		{
+			name:     "object member added",
+			from:     `{"a":1}`,
+			to:       `{"a":1,"b":2}`,
+			expected: `[{"op":"add","path":"/b","value":2}]`,
+		},
+		{
+			name:     "object member removed",
+			from:     `{"a":1,"b":2}`,
+			to:       `{"a":1}`,
+			expected: `[{"op":"remove","path":"/b"}]`,
+		},
+		{
+			name:     "object member replaced",
+			from:     `{"a":{"b":1}}`,
+			to:       `{"a":{"b":[1]}}`,
+			expected: `[{"op":"replace","path":"/a/b","value":[1]}]`,
+		},
+		{
+			name:     "array element inserted in the middle",
+			from:     `[1,2,3]`,
+			to:       `[1,2,"x",3]`,
+			expected: `[{"op":"add","path":"/2","value":"x"}]`,
+		},
+		{
+			name:     "array element removed from the middle",
+			from:     `[1,2,3,4]`,
+			to:       `[1,2,4]`,
+			expected: `[{"op":"remove","path":"/2"}]`,
+		},
+		{
+			name:     "moved value without move detection",
+			from:     `{"a":{"x":1},"b":{}}`,
+			to:       `{"a":{},"b":{"x":1}}`,
+			expected: `[{"op":"remove","path":"/a/x"},{"op":"add","path":"/b/x","value":1}]`,
+		},
+		{
+			name:     "move",
+			from:     `{"a":{"x":1},"b":{}}`,
+			to:       `{"a":{},"b":{"x":1}}`,
+			opts:     []DiffOption{DetectMoves()},
+			expected: `[{"op":"move","from":"/a/x","path":"/b/x"}]`,
+		},
+		{
+			name:     "copy",
+			from:     `{"a":{"x":[1,2]}}`,
+			to:       `{"a":{"x":[1,2]},"b":{"x":[1,2]}}`,
+			opts:     []DiffOption{DetectCopies()},
+			expected: `[{"op":"copy","from":"/a","path":"/b"}]`,
+		},
+		{
+			// The shortened patch adds "v" at /a/1 and then moves 2 from
+			// /a/0 to /a/2, which gives ["v",1,2].
+			name:     "falls back when the moves do not rebuild to",
+			from:     `{"a":[2,1]}`,
+			to:       `{"a":[1,"v",2]}`,
+			opts:     []DiffOption{DetectMoves()},
+			expected: `[{"op":"remove","path":"/a/0"},{"op":"add","path":"/a/1","value":"v"},{"op":"add","path":"/a/2","value":2}]`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			from := decodeJSON(t, c.from)
+			to := decodeJSON(t, c.to)
+			expected := decodeJSON(t, c.expected)
+
+			ops, err := Diff(from, to, c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := json.Marshal(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := decodeJSON(t, string(raw)); !reflect.DeepEqual(got, expected) {
+				t.Errorf("got %s, want %s", raw, c.expected)
+			}
+
+			result, err := Apply(from, ops)
+			if err != nil {
+				t.Fatalf("applying the diff: %v", err)
+			}
+			if !reflect.DeepEqual(result, to) {
+				t.Errorf("applying the diff gave %v, want %v", result, to)
+			}
+		})
+	}
+}
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package patch
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidPointer is returned for paths that are not valid RFC 6901
+	// JSON Pointers.
+	ErrInvalidPointer = errors.New("invalid JSON pointer")
+
+	// ErrInvalidOperation is returned for operations with an unknown op or
+	// missing members.
+	ErrInvalidOperation = errors.New("invalid operation")
+
+	// ErrPathNotFound is returned when a path, or one of its parents, does
+	// not exist in the document.
+	ErrPathNotFound = errors.New("path not found")
+
+	// ErrInvalidIndex is returned when an array is addressed with a token
+	// that is not a valid array index.
+	ErrInvalidIndex = errors.New("invalid array index")
+
+	// ErrIndexOutOfBounds is returned when an array index is outside the
+	// array.
+	ErrIndexOutOfBounds = errors.New("index out of bounds")
+
+	// ErrTestFailed is returned when a test operation does not match.
+	ErrTestFailed = errors.New("test failed")
+
+	// ErrNotAllowed is returned when an operation or path is excluded by
+	// AllowOps or AllowPaths.
+	ErrNotAllowed = errors.New("operation not allowed")
+
+	// ErrConflict is returned when a patch cannot be rebased over a
+	// concurrent change to the same values.
+	ErrConflict = errors.New("conflicting concurrent change")
+)
+
+// Error reports which operation of a patch failed. Use errors.Is with the
+// package's Err values to find out why.
+type Error struct {
+	Index int
+	Op    string
+	Path  string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %v", e.Index, e.Op, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
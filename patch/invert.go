@@ -0,0 +1,173 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Invert returns the patch that undoes ops: applying ops to doc and then the
+// returned patch gives back doc. Each inverse is computed from the values
+// ops overwrite or remove, so ops must apply cleanly to doc; the same
+// options as Apply are accepted. Test operations have no inverse.
+func Invert(doc interface{}, ops []Operation, opts ...Option) ([]Operation, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	inverses := make([][]Operation, 0, len(ops))
+	doc = DeepCopy(doc)
+	for i, op := range ops {
+		inverse, invErr := invertOp(doc, op, o.mode == Lenient)
+
+		var err error
+		doc, err = applyOp(doc, op, &o)
+		if err == nil {
+			err = invErr
+		}
+		if err != nil {
+			return nil, &Error{Index: i, Op: op.Op, Path: op.Path, Err: err}
+		}
+		inverses = append(inverses, inverse)
+	}
+
+	result := []Operation{}
+	for i := len(inverses) - 1; i >= 0; i-- {
+		result = append(result, inverses[i]...)
+	}
+	return result, nil
+}
+
+// invertOp returns the operations that undo op, given the document as it is
+// just before op is applied.
+func invertOp(doc interface{}, op Operation, createParents bool) ([]Operation, error) {
+	path, err := ParsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "copy":
+		if len(path) == 0 {
+			return restoreRoot(doc)
+		}
+		target, restore, err := addInverse(doc, path, createParents)
+		if err != nil {
+			return nil, err
+		}
+		if len(restore) == 1 && restore[0].Op == "add" && restore[0].Path == target.String() {
+			restore[0].Op = "replace"
+			return restore, nil
+		}
+		return append([]Operation{{Op: "remove", Path: target.String()}}, restore...), nil
+
+	case "remove":
+		old, err := Get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		inverse, err := valueOp("add", path, old)
+		if err != nil {
+			return nil, err
+		}
+		return []Operation{inverse}, nil
+
+	case "replace":
+		if len(path) == 0 {
+			return restoreRoot(doc)
+		}
+		old, err := Get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		inverse, err := valueOp("replace", path, old)
+		if err != nil {
+			return nil, err
+		}
+		return []Operation{inverse}, nil
+
+	case "move":
+		if len(path) == 0 {
+			return restoreRoot(doc)
+		}
+		from, err := ParsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		// A move is a remove followed by an add, so the add's inverse has to
+		// be worked out against the document with from already removed.
+		removed, err := remove(DeepCopy(doc), from)
+		if err != nil {
+			return nil, err
+		}
+		target, restore, err := addInverse(removed, path, createParents)
+		if err != nil {
+			return nil, err
+		}
+		return append([]Operation{{Op: "move", From: target.String(), Path: from.String()}}, restore...), nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// addInverse works out how to undo adding a value at path in doc. target is
+// where the value ends up, with "-" resolved to a concrete index; restore
+// holds the operations to apply once the value is removed from target again,
+// putting back an overwritten member or removing parents created in lenient
+// mode.
+func addInverse(doc interface{}, path Pointer, createParents bool) (Pointer, []Operation, error) {
+	parentPath := path[:len(path)-1]
+	parent, err := Get(doc, parentPath)
+	if err != nil {
+		if !createParents {
+			return nil, nil, err
+		}
+		for i := 1; i <= len(parentPath); i++ {
+			if _, err := Get(doc, path[:i]); err != nil {
+				return path, []Operation{{Op: "remove", Path: path[:i].String()}}, nil
+			}
+		}
+		return nil, nil, err
+	}
+
+	key := path[len(path)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		old, ok := container[key]
+		if !ok {
+			return path, nil, nil
+		}
+		restore, err := valueOp("add", path, old)
+		if err != nil {
+			return nil, nil, err
+		}
+		return path, []Operation{restore}, nil
+	case []interface{}:
+		idx, err := parseArrayIndex(key, len(container), true, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		target := append(Pointer{}, parentPath...)
+		return append(target, strconv.Itoa(idx)), nil, nil
+	default:
+		return nil, nil, notContainerError(parentPath)
+	}
+}
+
+func restoreRoot(doc interface{}) ([]Operation, error) {
+	inverse, err := valueOp("replace", Pointer{}, doc)
+	if err != nil {
+		return nil, err
+	}
+	return []Operation{inverse}, nil
+}
+
+func valueOp(kind string, path Pointer, value interface{}) (Operation, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return Operation{}, fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+	}
+	return Operation{Op: kind, Path: path.String(), Value: raw}, nil
+}
@@ -0,0 +1,501 @@
+// Package patch implements RFC 6902 JSON Patch over decoded JSON values
+// (the interface{} trees produced by encoding/json), with RFC 6901 JSON
+// Pointer addressing into objects and arrays.
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Operation is a single JSON Patch operation. Value holds the raw JSON of the
+// "value" member and is nil when the member is absent.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// UnmarshalJSON decodes an operation and rejects ones missing the "op" or
+// "path" members, or the "from" member of move and copy.
+func (o *Operation) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Op    *string         `json:"op"`
+		Path  *string         `json:"path"`
+		From  *string         `json:"from"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw.Op == nil {
+		return fmt.Errorf("%w: missing op", ErrInvalidOperation)
+	}
+	if raw.Path == nil {
+		return fmt.Errorf("%w: %s is missing path", ErrInvalidOperation, *raw.Op)
+	}
+	if raw.From == nil && (*raw.Op == "move" || *raw.Op == "copy") {
+		return fmt.Errorf("%w: %s is missing from", ErrInvalidOperation, *raw.Op)
+	}
+
+	*o = Operation{Op: *raw.Op, Path: *raw.Path, Value: raw.Value}
+	if raw.From != nil {
+		o.From = *raw.From
+	}
+	return nil
+}
+
+// ValueInterface decodes the operation's value.
+func (o Operation) ValueInterface() (interface{}, error) {
+	if o.Value == nil {
+		return nil, fmt.Errorf("%w: %s is missing value", ErrInvalidOperation, o.Op)
+	}
+	var v interface{}
+	if err := json.Unmarshal(o.Value, &v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+	}
+	return v, nil
+}
+
+// Mode selects how strictly Apply follows RFC 6902.
+type Mode int
+
+const (
+	// Strict rejects an add whose target's parent does not exist, as RFC
+	// 6902 requires. It is the default.
+	Strict Mode = iota
+	// Lenient creates missing parent objects for add operations.
+	Lenient
+)
+
+// ParseMode parses "strict" or "lenient". The empty string means Strict.
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "strict":
+		return Strict, nil
+	case "lenient":
+		return Lenient, nil
+	default:
+		return Strict, fmt.Errorf("unknown patch mode %q", s)
+	}
+}
+
+func (m Mode) String() string {
+	if m == Lenient {
+		return "lenient"
+	}
+	return "strict"
+}
+
+// Option configures Apply.
+type Option func(*options)
+
+type options struct {
+	mode         Mode
+	allowedOps   map[string]bool
+	allowedPaths map[string]bool
+}
+
+// WithMode sets the patch mode.
+func WithMode(m Mode) Option {
+	return func(o *options) {
+		o.mode = m
+	}
+}
+
+// AllowOps restricts a patch to the given operation kinds.
+func AllowOps(kinds ...string) Option {
+	return func(o *options) {
+		o.allowedOps = make(map[string]bool, len(kinds))
+		for _, kind := range kinds {
+			o.allowedOps[kind] = true
+		}
+	}
+}
+
+// AllowPaths restricts the "path" and "from" members of a patch to the given
+// JSON Pointers. A pointer ending in "/*" allows any one reference token in
+// place of the "*", so "/tags/*" allows "/tags/0" and "/tags/-" but not
+// "/tags" or "/tags/0/name".
+func AllowPaths(paths ...string) Option {
+	return func(o *options) {
+		o.allowedPaths = make(map[string]bool, len(paths))
+		for _, path := range paths {
+			o.allowedPaths[path] = true
+		}
+	}
+}
+
+func (o *options) pathAllowed(path string) bool {
+	if o.allowedPaths[path] {
+		return true
+	}
+	i := strings.LastIndexByte(path, '/')
+	return i >= 0 && o.allowedPaths[path[:i]+"/*"]
+}
+
+// Apply applies ops to doc in order and returns the resulting document. The
+// input is not modified. If any operation fails, Apply returns an *Error
+// naming it and the patch is not applied at all.
+func Apply(doc interface{}, ops []Operation, opts ...Option) (interface{}, error) {
+	doc, _, err := ApplyWithResults(doc, ops, opts...)
+	return doc, err
+}
+
+// Result reports what one operation of a patch did. Changed lists the
+// locations the operation wrote to or removed; it is empty for test.
+type Result struct {
+	Index   int      `json:"index"`
+	Op      string   `json:"op"`
+	Path    string   `json:"path"`
+	From    string   `json:"from,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// ApplyWithResults is like Apply but also reports the outcome of each
+// operation. On failure the results end with the failing operation.
+func ApplyWithResults(doc interface{}, ops []Operation, opts ...Option) (interface{}, []Result, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	results := make([]Result, 0, len(ops))
+	doc = DeepCopy(doc)
+	for i, op := range ops {
+		result := Result{Index: i, Op: op.Op, Path: op.Path, From: op.From}
+
+		var err error
+		doc, err = applyOp(doc, op, &o)
+		if err != nil {
+			patchErr := &Error{Index: i, Op: op.Op, Path: op.Path, Err: err}
+			result.Error = err.Error()
+			return nil, append(results, result), patchErr
+		}
+
+		switch op.Op {
+		case "move":
+			result.Changed = []string{op.From, op.Path}
+		case "test":
+		default:
+			result.Changed = []string{op.Path}
+		}
+		results = append(results, result)
+	}
+	return doc, results, nil
+}
+
+func applyOp(doc interface{}, op Operation, o *options) (interface{}, error) {
+	if o.allowedOps != nil && !o.allowedOps[op.Op] {
+		return nil, fmt.Errorf("%w: %s", ErrNotAllowed, op.Op)
+	}
+	if o.allowedPaths != nil {
+		if !o.pathAllowed(op.Path) {
+			return nil, fmt.Errorf("%w: path %s", ErrNotAllowed, op.Path)
+		}
+		if (op.Op == "move" || op.Op == "copy") && !o.pathAllowed(op.From) {
+			return nil, fmt.Errorf("%w: path %s", ErrNotAllowed, op.From)
+		}
+	}
+
+	path, err := ParsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		value, err := op.ValueInterface()
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value, o.mode == Lenient)
+
+	case "remove":
+		return remove(doc, path)
+
+	case "replace":
+		value, err := op.ValueInterface()
+		if err != nil {
+			return nil, err
+		}
+		return replace(doc, path, value)
+
+	case "move":
+		from, err := ParsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		return move(doc, from, path, o.mode == Lenient)
+
+	case "copy":
+		from, err := ParsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		return copyValue(doc, from, path, o.mode == Lenient)
+
+	case "test":
+		value, err := op.ValueInterface()
+		if err != nil {
+			return nil, err
+		}
+		return doc, test(doc, path, value)
+
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidOperation, op.Op)
+	}
+}
+
+// The operations below return the new document, which differs from the
+// input when the root itself is replaced or when a top-level array grows or
+// shrinks.
+
+func add(doc interface{}, path Pointer, value interface{}, createParents bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return setNestedValue(doc, path, path, value, createParents)
+}
+
+func remove(doc interface{}, path Pointer) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the document root", ErrInvalidOperation)
+	}
+
+	return removeNestedValue(doc, path, path)
+}
+
+func replace(doc interface{}, path Pointer, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	if _, err := Get(doc, path); err != nil {
+		return nil, err
+	}
+
+	return doc, replaceNestedValue(doc, path, value)
+}
+
+func move(doc interface{}, from, to Pointer, createParents bool) (interface{}, error) {
+	if from.IsPrefixOf(to) {
+		return nil, fmt.Errorf("%w: cannot move %s into its own child %s", ErrInvalidOperation, from, to)
+	}
+
+	value, err := Get(doc, from)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = remove(doc, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return add(doc, to, value, createParents)
+}
+
+func copyValue(doc interface{}, from, to Pointer, createParents bool) (interface{}, error) {
+	value, err := Get(doc, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return add(doc, to, DeepCopy(value), createParents)
+}
+
+func test(doc interface{}, path Pointer, value interface{}) error {
+	currentValue, err := Get(doc, path)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(currentValue, value) {
+		return fmt.Errorf("%w: values do not match at path %s", ErrTestFailed, path)
+	}
+	return nil
+}
+
+// Get returns the value path points to in doc.
+func Get(doc interface{}, path Pointer) (interface{}, error) {
+	current := doc
+	for i, key := range path {
+		switch container := current.(type) {
+		case map[string]interface{}:
+			next, ok := container[key]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:i+1])
+			}
+			current = next
+		case []interface{}:
+			idx, err := parseArrayIndex(key, len(container), false, path[:i+1])
+			if err != nil {
+				return nil, err
+			}
+			current = container[idx]
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path[:i+1])
+		}
+	}
+	return current, nil
+}
+
+// setNestedValue adds value at path, walking through objects and arrays.
+// Missing intermediate object keys are an error unless createParents is set;
+// array tokens must name an existing element, except for the final token
+// which may be "-" (append) or an index in [0, len] (insert with shifting).
+func setNestedValue(node interface{}, path, fullPath Pointer, value interface{}, createParents bool) (interface{}, error) {
+	depth := len(fullPath) - len(path) + 1
+	key := path[0]
+
+	if len(path) == 1 {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			container[key] = value
+			return container, nil
+		case []interface{}:
+			idx, err := parseArrayIndex(key, len(container), true, fullPath[:depth])
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[idx+1:], container[idx:])
+			container[idx] = value
+			return container, nil
+		default:
+			return nil, notContainerError(fullPath[:depth-1])
+		}
+	}
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		child, ok := container[key]
+		if !ok {
+			if !createParents {
+				return nil, fmt.Errorf("%w: %s", ErrPathNotFound, fullPath[:depth])
+			}
+			child = make(map[string]interface{})
+		}
+		newChild, err := setNestedValue(child, path[1:], fullPath, value, createParents)
+		if err != nil {
+			return nil, err
+		}
+		container[key] = newChild
+		return container, nil
+	case []interface{}:
+		idx, err := parseArrayIndex(key, len(container), false, fullPath[:depth])
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := setNestedValue(container[idx], path[1:], fullPath, value, createParents)
+		if err != nil {
+			return nil, err
+		}
+		container[idx] = newChild
+		return container, nil
+	default:
+		return nil, notContainerError(fullPath[:depth-1])
+	}
+}
+
+// replaceNestedValue overwrites the existing value at path in place.
+func replaceNestedValue(doc interface{}, path Pointer, value interface{}) error {
+	parent, err := Get(doc, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+
+	key := path[len(path)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[key] = value
+	case []interface{}:
+		idx, err := parseArrayIndex(key, len(container), false, path)
+		if err != nil {
+			return err
+		}
+		container[idx] = value
+	default:
+		return notContainerError(path[:len(path)-1])
+	}
+	return nil
+}
+
+// removeNestedValue deletes the value at path. Removing an array element
+// shifts the following elements down so the array stays compact.
+func removeNestedValue(node interface{}, path, fullPath Pointer) (interface{}, error) {
+	depth := len(fullPath) - len(path) + 1
+	key := path[0]
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		child, ok := container[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, fullPath[:depth])
+		}
+		if len(path) == 1 {
+			delete(container, key)
+			return container, nil
+		}
+		newChild, err := removeNestedValue(child, path[1:], fullPath)
+		if err != nil {
+			return nil, err
+		}
+		container[key] = newChild
+		return container, nil
+	case []interface{}:
+		idx, err := parseArrayIndex(key, len(container), false, fullPath[:depth])
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 {
+			return append(container[:idx], container[idx+1:]...), nil
+		}
+		newChild, err := removeNestedValue(container[idx], path[1:], fullPath)
+		if err != nil {
+			return nil, err
+		}
+		container[idx] = newChild
+		return container, nil
+	default:
+		return nil, notContainerError(fullPath[:depth-1])
+	}
+}
+
+func notContainerError(path Pointer) error {
+	if len(path) == 0 {
+		return fmt.Errorf("%w: document root is not an object or array", ErrPathNotFound)
+	}
+	return fmt.Errorf("%w: %s is not an object or array", ErrPathNotFound, path)
+}
+
+// DeepCopy returns a copy of a decoded JSON value that shares no maps or
+// slices with the original.
+func DeepCopy(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		newMap := make(map[string]interface{})
+		for k, v := range v {
+			newMap[k] = DeepCopy(v)
+		}
+		return newMap
+	case []interface{}:
+		newSlice := make([]interface{}, len(v))
+		for i, v := range v {
+			newSlice[i] = DeepCopy(v)
+		}
+		return newSlice
+	default:
+		return v
+	}
+}
@@ -0,0 +1,211 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestApplyErrors(t *testing.T) {
+	doc := map[string]interface{}{
+		"name": "a",
+		"tags": []interface{}{"x", "y"},
+	}
+
+	cases := []struct {
+		name  string
+		ops   string
+		opts  []Option
+		err   error
+		index int
+	}{
+		{
+			name:  "remove of a missing member",
+			ops:   `[{"op":"replace","path":"/name","value":"b"},{"op":"remove","path":"/missing"}]`,
+			err:   ErrPathNotFound,
+			index: 1,
+		},
+		{
+			name: "replace below a missing member",
+			ops:  `[{"op":"replace","path":"/missing/name","value":"b"}]`,
+			err:  ErrPathNotFound,
+		},
+		{
+			name:  "failed test",
+			ops:   `[{"op":"add","path":"/tags/-","value":"z"},{"op":"test","path":"/tags/2","value":"y"}]`,
+			err:   ErrTestFailed,
+			index: 1,
+		},
+		{
+			name: "index past the end",
+			ops:  `[{"op":"remove","path":"/tags/2"}]`,
+			err:  ErrIndexOutOfBounds,
+		},
+		{
+			name: "unknown op",
+			ops:  `[{"op":"merge","path":"/name"}]`,
+			err:  ErrInvalidOperation,
+		},
+		{
+			name:  "op left out of AllowOps",
+			ops:   `[{"op":"replace","path":"/name","value":"b"},{"op":"remove","path":"/tags"}]`,
+			opts:  []Option{AllowOps("add", "replace")},
+			err:   ErrNotAllowed,
+			index: 1,
+		},
+		{
+			name: "path left out of AllowPaths",
+			ops:  `[{"op":"replace","path":"/name","value":"b"}]`,
+			opts: []Option{AllowPaths("/tags")},
+			err:  ErrNotAllowed,
+		},
+		{
+			name: "move from a path left out of AllowPaths",
+			ops:  `[{"op":"move","from":"/name","path":"/tags"}]`,
+			opts: []Option{AllowPaths("/tags")},
+			err:  ErrNotAllowed,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := Apply(doc, parseOps(t, c.ops), c.opts...)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got %v, %v; want %v", result, err, c.err)
+			}
+			var patchErr *Error
+			if !errors.As(err, &patchErr) {
+				t.Fatalf("%v is not an *Error", err)
+			}
+			if patchErr.Index != c.index {
+				t.Errorf("Index = %d, want %d", patchErr.Index, c.index)
+			}
+		})
+	}
+
+	if doc["name"] != "a" || len(doc["tags"].([]interface{})) != 2 {
+		t.Errorf("failed patches modified the input: %v", doc)
+	}
+}
+
+func TestAllowOps(t *testing.T) {
+	doc := map[string]interface{}{"name": "a"}
+	ops := parseOps(t, `[{"op":"test","path":"/name","value":"a"},{"op":"replace","path":"/name","value":"b"}]`)
+
+	result, err := Apply(doc, ops, AllowOps("test", "replace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"name": "b"}; !reflect.DeepEqual(result, want) {
+		t.Errorf("got %v, want %v", result, want)
+	}
+
+	if _, err := Apply(doc, ops, AllowOps("replace")); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("test outside AllowOps: got %v, want ErrNotAllowed", err)
+	}
+}
+
+func TestModes(t *testing.T) {
+	doc := map[string]interface{}{"a": float64(1)}
+	cases := []struct {
+		name    string
+		ops     string
+		lenient string
+	}{
+		{
+			name:    "add under a missing parent",
+			ops:     `[{"op":"add","path":"/b/c/d","value":2}]`,
+			lenient: `{"a":1,"b":{"c":{"d":2}}}`,
+		},
+		{
+			name:    "move under a missing parent",
+			ops:     `[{"op":"move","from":"/a","path":"/b/c"}]`,
+			lenient: `{"b":{"c":1}}`,
+		},
+		{
+			name:    "copy under a missing parent",
+			ops:     `[{"op":"copy","from":"/a","path":"/b/c"}]`,
+			lenient: `{"a":1,"b":{"c":1}}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ops := parseOps(t, c.ops)
+			if _, err := Apply(doc, ops); !errors.Is(err, ErrPathNotFound) {
+				t.Errorf("default mode: got %v, want ErrPathNotFound", err)
+			}
+			if _, err := Apply(doc, ops, WithMode(Strict)); !errors.Is(err, ErrPathNotFound) {
+				t.Errorf("Strict: got %v, want ErrPathNotFound", err)
+			}
+
+			result, err := Apply(doc, ops, WithMode(Lenient))
+			if err != nil {
+				t.Fatalf("Lenient: %v", err)
+			}
+			var want interface{}
+			if err := json.Unmarshal([]byte(c.lenient), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, want) {
+				t.Errorf("Lenient: got %v, want %v", result, want)
+			}
+		})
+	}
+
+	// Lenient only creates objects; it does not pad arrays.
+	lenient := WithMode(Lenient)
+	if _, err := Apply(map[string]interface{}{"a": []interface{}{}}, parseOps(t, `[{"op":"add","path":"/a/0/b","value":1}]`), lenient); err == nil {
+		t.Error("Lenient add below a missing array element succeeded")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for s, want := range map[string]Mode{"": Strict, "strict": Strict, "lenient": Lenient} {
+		if got, err := ParseMode(s); err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseMode("loose"); err == nil {
+		t.Error(`ParseMode("loose") succeeded`)
+	}
+}
+
+func TestAllowPaths(t *testing.T) {
+	doc := map[string]interface{}{
+		"name": "a",
+		"tags": []interface{}{"x", "y"},
+	}
+	allow := AllowPaths("/name", "/tags", "/tags/*")
+
+	cases := []struct {
+		ops     string
+		allowed bool
+	}{
+		{`[{"op":"replace","path":"/name","value":"b"}]`, true},
+		{`[{"op":"add","path":"/tags/-","value":"z"}]`, true},
+		{`[{"op":"remove","path":"/tags/0"}]`, true},
+		{`[{"op":"copy","from":"/tags/1","path":"/name"}]`, true},
+		{`[{"op":"add","path":"/other","value":1}]`, false},
+		{`[{"op":"copy","from":"/other","path":"/name"}]`, false},
+		{`[{"op":"add","path":"/tags/0/x","value":1}]`, false},
+	}
+	for _, c := range cases {
+		var ops []Operation
+		mustUnmarshal(t, c.ops, &ops)
+		_, err := Apply(doc, ops, allow)
+		if got := !errors.Is(err, ErrNotAllowed); got != c.allowed {
+			t.Errorf("%s: allowed = %v, want %v (err %v)", c.ops, got, c.allowed, err)
+		}
+	}
+}
+
+func parseOps(t *testing.T, s string) []Operation {
+	t.Helper()
+	var ops []Operation
+	if err := json.Unmarshal([]byte(s), &ops); err != nil {
+		t.Fatal(err)
+	}
+	return ops
+}
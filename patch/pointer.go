@@ -0,0 +1,84 @@
+package patch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pointer is a decoded RFC 6901 JSON Pointer. A nil or empty Pointer refers
+// to the whole document.
+type Pointer []string
+
+// ParsePointer decodes s into reference tokens, unescaping "~1" to "/" and
+// "~0" to "~". The empty string is the root pointer.
+func ParsePointer(s string) (Pointer, error) {
+	if s == "" {
+		return Pointer{}, nil
+	}
+	if s[0] != '/' {
+		return nil, fmt.Errorf("%w %q: must be empty or start with /", ErrInvalidPointer, s)
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] == '~' && (j+1 == len(token) || (token[j+1] != '0' && token[j+1] != '1')) {
+				return nil, fmt.Errorf("%w %q: bad escape sequence", ErrInvalidPointer, s)
+			}
+		}
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return Pointer(tokens), nil
+}
+
+// String re-escapes the pointer into its RFC 6901 string form.
+func (p Pointer) String() string {
+	var b strings.Builder
+	for _, token := range p {
+		b.WriteByte('/')
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// IsPrefixOf reports whether p is a proper prefix of other, that is whether
+// other points somewhere inside the value p points to.
+func (p Pointer) IsPrefixOf(other Pointer) bool {
+	if len(p) >= len(other) {
+		return false
+	}
+	for i := range p {
+		if p[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseArrayIndex validates an array reference token. When forAdd is set the
+// index may equal the array length and "-" refers to the end of the array.
+func parseArrayIndex(token string, length int, forAdd bool, path Pointer) (int, error) {
+	if token == "-" {
+		if forAdd {
+			return length, nil
+		}
+		return 0, fmt.Errorf("%w: %s", ErrIndexOutOfBounds, path)
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidIndex, path)
+	}
+	for _, c := range token {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%w: %s", ErrInvalidIndex, path)
+		}
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidIndex, path)
+	}
+	if idx > length || (idx == length && !forAdd) {
+		return 0, fmt.Errorf("%w: %s", ErrIndexOutOfBounds, path)
+	}
+	return idx, nil
+}
@@ -0,0 +1,313 @@
+package patch
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Conflict describes an operation of a stale patch that clashes with a
+// concurrent change: both touch the same value, or the concurrent change
+// removed or replaced something the operation refers to.
+type Conflict struct {
+	// Index is the position of the operation in the patch being rebased.
+	Index int       `json:"index"`
+	Op    string    `json:"op"`
+	Path  string    `json:"path"`
+	With  Operation `json:"with"`
+}
+
+// RebaseError is returned by Rebase when the patch cannot be rebased
+// cleanly. It wraps ErrConflict.
+type RebaseError struct {
+	Conflicts []Conflict
+}
+
+func (e *RebaseError) Error() string {
+	parts := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		parts[i] = fmt.Sprintf("operation %d (%s %s) clashes with %s %s", c.Index, c.Op, c.Path, c.With.Op, c.With.Path)
+	}
+	return fmt.Sprintf("%v: %s", ErrConflict, strings.Join(parts, "; "))
+}
+
+func (e *RebaseError) Unwrap() error {
+	return ErrConflict
+}
+
+// Rebase transforms ops, a patch written against base, so that it applies
+// after over, the patches applied to base since. Array indexes are shifted
+// past concurrent inserts and removals, and paths inside moved values follow
+// the move. Operations that touch a value the concurrent patches changed,
+// replaced or removed, or that would not apply once rebased, are reported
+// in a *RebaseError.
+//
+// Both patches must apply to base; opts are used when applying ops.
+func Rebase(base interface{}, ops, over []Operation, opts ...Option) ([]Operation, error) {
+	concurrent, err := prepareRebaseOps(base, over, WithMode(Lenient))
+	if err != nil {
+		return nil, fmt.Errorf("concurrent patch: %w", err)
+	}
+	local, err := prepareRebaseOps(base, ops, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each local operation is transformed past every concurrent one, while
+	// the concurrent ones are transformed past it in turn so that they stay
+	// expressed in the coordinates the next local operation expects.
+	rebased := make([]Operation, 0, len(local))
+	// shiftedBy is, for each local operation, the concurrent operation that
+	// last changed its pointers, for reporting clashes found by the final
+	// check below.
+	shiftedBy := make([]Operation, len(local))
+	var conflicts []Conflict
+	for i, l := range local {
+		current := l
+		clashed := false
+		if len(over) > 0 {
+			shiftedBy[i] = over[len(over)-1]
+		}
+		for j, c := range concurrent {
+			next, pathConflict, fromConflict := transform(current, c, true)
+			// Moving the concurrent operation past the local one clashes
+			// when the local one changed where the concurrent one wrote,
+			// such as removing the parent of where it moved a value to.
+			// Clashes over its "from" are already settled by the local
+			// operation following the moved value.
+			var written bool
+			concurrent[j], written, _ = transform(c, current, false)
+			if (pathConflict || fromConflict || written) && !clashed {
+				conflicts = append(conflicts, Conflict{Index: i, Op: l.op.Op, Path: l.op.Path, With: over[j]})
+				clashed = true
+			}
+			if next.op.Path != current.op.Path || next.op.From != current.op.From {
+				shiftedBy[i] = over[j]
+			}
+			current = next
+		}
+		rebased = append(rebased, current.op)
+	}
+
+	if len(conflicts) == 0 {
+		// The transforms do not model every interaction of moves and
+		// removals, such as both sides moving the same value, so check that
+		// the result applies and report the operation that does not.
+		doc, err := Apply(base, over, WithMode(Lenient))
+		if err != nil {
+			return nil, fmt.Errorf("concurrent patch: %w", err)
+		}
+		var patchErr *Error
+		if _, err := Apply(doc, rebased, opts...); errors.As(err, &patchErr) {
+			i := patchErr.Index
+			conflicts = append(conflicts, Conflict{Index: i, Op: ops[i].Op, Path: ops[i].Path, With: shiftedBy[i]})
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, &RebaseError{Conflicts: conflicts}
+	}
+	return rebased, nil
+}
+
+// rebaseOp is an operation with its pointers decoded and, for the location
+// each pointer's last token indexes, whether it is an array element.
+type rebaseOp struct {
+	op          Operation
+	path, from  Pointer
+	pathInArray bool
+	fromInArray bool
+}
+
+// prepareRebaseOps applies ops to doc one by one, recording which pointers
+// address array elements and resolving "-" to the index it appended at.
+func prepareRebaseOps(doc interface{}, ops []Operation, opts ...Option) ([]rebaseOp, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	prepared := make([]rebaseOp, 0, len(ops))
+	doc = DeepCopy(doc)
+	for i, op := range ops {
+		r := rebaseOp{op: op}
+		var err error
+		if r.path, err = ParsePointer(op.Path); err != nil {
+			return nil, &Error{Index: i, Op: op.Op, Path: op.Path, Err: err}
+		}
+		if op.Op == "move" || op.Op == "copy" {
+			if r.from, err = ParsePointer(op.From); err != nil {
+				return nil, &Error{Index: i, Op: op.Op, Path: op.Path, Err: err}
+			}
+			r.fromInArray = inArray(doc, r.from)
+		}
+		r.pathInArray = inArray(doc, r.path)
+
+		doc, err = applyOp(doc, op, &o)
+		if err != nil {
+			return nil, &Error{Index: i, Op: op.Op, Path: op.Path, Err: err}
+		}
+
+		if r.pathInArray && len(r.path) > 0 && r.path[len(r.path)-1] == "-" {
+			if parent, ok := mustGet(doc, r.path[:len(r.path)-1]).([]interface{}); ok {
+				r.path = append(append(Pointer{}, r.path[:len(r.path)-1]...), strconv.Itoa(len(parent)-1))
+				r.op.Path = r.path.String()
+			}
+		}
+		prepared = append(prepared, r)
+	}
+	return prepared, nil
+}
+
+// inArray reports whether path's last token indexes an array in doc.
+func inArray(doc interface{}, path Pointer) bool {
+	if len(path) == 0 {
+		return false
+	}
+	_, ok := mustGet(doc, path[:len(path)-1]).([]interface{})
+	return ok
+}
+
+func mustGet(doc interface{}, path Pointer) interface{} {
+	value, err := Get(doc, path)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// transform rewrites the pointers of x so that x applies after y, where both
+// were written against the same document. When both insert at the same array
+// index, x moves behind y if yFirst is set. The results report whether x's
+// path and from touch a value y changed.
+func transform(x, y rebaseOp, yFirst bool) (rebaseOp, bool, bool) {
+	var pathConflict, fromConflict bool
+	insert := (x.op.Op == "add" || x.op.Op == "copy" || x.op.Op == "move") && x.pathInArray
+	x.path, x.pathInArray, pathConflict = shiftPointer(x.path, x.pathInArray, insert, y, yFirst)
+	x.op.Path = x.path.String()
+	if x.op.Op == "move" || x.op.Op == "copy" {
+		x.from, x.fromInArray, fromConflict = shiftPointer(x.from, x.fromInArray, false, y, yFirst)
+		x.op.From = x.from.String()
+	}
+	return x, pathConflict, fromConflict
+}
+
+// shiftPointer returns where p points once y has been applied, along with
+// whether its last token then indexes an array. insert marks p as the
+// position an add inserts at rather than an existing value.
+func shiftPointer(p Pointer, inArray, insert bool, y rebaseOp, yFirst bool) (Pointer, bool, bool) {
+	switch y.op.Op {
+	case "add", "copy":
+		p, conflict := shiftForAdd(p, insert, y.path, y.pathInArray, yFirst)
+		return p, inArray, conflict
+	case "remove":
+		p, conflict := shiftForRemove(p, insert, y.path, y.pathInArray)
+		return p, inArray, conflict
+	case "replace":
+		if y.pathInArray && insert && len(p) == len(y.path) {
+			return p, inArray, false
+		}
+		return p, inArray, within(p, y.path)
+	case "move":
+		// Pointers into the moved value follow it to its new location.
+		if within(p, y.from) && !(y.fromInArray && insert && len(p) == len(y.from)) {
+			if len(p) == len(y.from) {
+				inArray = y.pathInArray
+			}
+			return append(clonePointer(y.path), p[len(y.from):]...), inArray, false
+		}
+		if len(y.path) == 0 {
+			return p, inArray, true
+		}
+		p, conflict := shiftForRemove(p, insert, y.from, y.fromInArray)
+		if conflict {
+			return p, inArray, true
+		}
+		p, conflict = shiftForAdd(p, insert, y.path, y.pathInArray, yFirst)
+		return p, inArray, conflict
+	default:
+		return p, inArray, false
+	}
+}
+
+// shiftForAdd moves p past a value added at target: array indexes at or
+// after an insert shift up, and anything at or under an added object member
+// or a new root clashes with it.
+func shiftForAdd(p Pointer, insert bool, target Pointer, targetInArray, yFirst bool) (Pointer, bool) {
+	if !targetInArray {
+		return p, within(p, target)
+	}
+	parent, idx := target[:len(target)-1], arrayIndex(target)
+	j, ok := indexAt(p, parent)
+	if !ok {
+		return p, false
+	}
+	atPosition := insert && len(p) == len(target)
+	if j > idx || (j == idx && (!atPosition || yFirst)) {
+		p = clonePointer(p)
+		p[len(parent)] = strconv.Itoa(j + 1)
+	}
+	return p, false
+}
+
+// shiftForRemove moves p past a value removed at target: later array indexes
+// shift down, and anything at or under the removed value clashes with it,
+// except an insert at the removed index.
+func shiftForRemove(p Pointer, insert bool, target Pointer, targetInArray bool) (Pointer, bool) {
+	if !targetInArray {
+		return p, within(p, target)
+	}
+	parent, idx := target[:len(target)-1], arrayIndex(target)
+	j, ok := indexAt(p, parent)
+	if !ok {
+		return p, false
+	}
+	switch {
+	case j > idx:
+		p = clonePointer(p)
+		p[len(parent)] = strconv.Itoa(j - 1)
+	case j == idx && !(insert && len(p) == len(target)):
+		return p, true
+	}
+	return p, false
+}
+
+// within reports whether p points at target or somewhere inside it.
+func within(p, target Pointer) bool {
+	if len(p) < len(target) {
+		return false
+	}
+	for i := range target {
+		if p[i] != target[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexAt returns the array index p has right below parent, if p passes
+// through parent.
+func indexAt(p, parent Pointer) (int, bool) {
+	if !parent.IsPrefixOf(p) {
+		return 0, false
+	}
+	j, err := strconv.Atoi(p[len(parent)])
+	if err != nil {
+		return 0, false
+	}
+	return j, true
+}
+
+func arrayIndex(p Pointer) int {
+	idx, _ := strconv.Atoi(p[len(p)-1])
+	return idx
+}
+
+func clonePointer(p Pointer) Pointer {
+	if p == nil {
+		return nil
+	}
+	return append(Pointer{}, p...)
+}
@@ -0,0 +1,127 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRebase(t *testing.T) {
+	cases := []struct {
+		name     string
+		base     string
+		over     string
+		ops      string
+		expected string // document after over and the rebased ops; "" for a conflict
+	}{
+		{
+			name:     "index shifts down past a remove",
+			base:     `{"a":[1,2,3]}`,
+			over:     `[{"op":"remove","path":"/a/0"}]`,
+			ops:      `[{"op":"replace","path":"/a/2","value":9}]`,
+			expected: `{"a":[2,9]}`,
+		},
+		{
+			name:     "append stays an append",
+			base:     `{"a":[1,2,3]}`,
+			over:     `[{"op":"add","path":"/a/0","value":0}]`,
+			ops:      `[{"op":"add","path":"/a/-","value":4}]`,
+			expected: `{"a":[0,1,2,3,4]}`,
+		},
+		{
+			name:     "concurrent inserts at one index keep the earlier first",
+			base:     `{"a":[1,2,3]}`,
+			over:     `[{"op":"add","path":"/a/1","value":"S"}]`,
+			ops:      `[{"op":"add","path":"/a/1","value":"C"}]`,
+			expected: `{"a":[1,"S","C",2,3]}`,
+		},
+		{
+			name:     "paths follow a moved value",
+			base:     `{"a":[1,2,3]}`,
+			over:     `[{"op":"move","from":"/a","path":"/b"}]`,
+			ops:      `[{"op":"replace","path":"/a/1","value":9}]`,
+			expected: `{"b":[1,9,3]}`,
+		},
+		{
+			name:     "later ops see earlier local inserts",
+			base:     `{"a":[1,2,3]}`,
+			over:     `[{"op":"remove","path":"/a/1"}]`,
+			ops:      `[{"op":"add","path":"/a/1","value":"X"},{"op":"replace","path":"/a/1","value":"Y"}]`,
+			expected: `{"a":[1,"Y",3]}`,
+		},
+		{
+			name:     "element moved out of an array",
+			base:     `{"a":[1,2,3],"b":{}}`,
+			over:     `[{"op":"add","path":"/a/-","value":"S"},{"op":"move","from":"/a/0","path":"/b/x"}]`,
+			ops:      `[{"op":"replace","path":"/a/0","value":"C"},{"op":"remove","path":"/a/2"}]`,
+			expected: `{"a":[2,"S"],"b":{"x":"C"}}`,
+		},
+		{
+			name: "concurrent replace of the same value",
+			base: `{"a":[1,2,3]}`,
+			over: `[{"op":"replace","path":"/a/1","value":5}]`,
+			ops:  `[{"op":"replace","path":"/a/1","value":9}]`,
+		},
+		{
+			name: "local remove of the parent a value was moved into",
+			base: `{"a":0,"b":{}}`,
+			over: `[{"op":"move","from":"/a","path":"/b/x"}]`,
+			ops:  `[{"op":"remove","path":"/b"},{"op":"replace","path":"/a","value":1}]`,
+		},
+		{
+			name: "both sides move the same value",
+			base: `{"a":{"x":1},"c":[]}`,
+			over: `[{"op":"move","from":"/a","path":"/d"}]`,
+			ops:  `[{"op":"move","from":"/a","path":"/b"},{"op":"move","from":"/b","path":"/c/0"}]`,
+		},
+		{
+			name: "edit inside a removed value",
+			base: `{"a":{"x":1}}`,
+			over: `[{"op":"remove","path":"/a"}]`,
+			ops:  `[{"op":"replace","path":"/a/x","value":2}]`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var base interface{}
+			var over, ops []Operation
+			mustUnmarshal(t, c.base, &base)
+			mustUnmarshal(t, c.over, &over)
+			mustUnmarshal(t, c.ops, &ops)
+
+			rebased, err := Rebase(base, ops, over)
+			if c.expected == "" {
+				var rebaseErr *RebaseError
+				if !errors.As(err, &rebaseErr) || !errors.Is(err, ErrConflict) {
+					t.Fatalf("expected a conflict, got %v, %v", rebased, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := Apply(base, over)
+			if err == nil {
+				result, err = Apply(result, rebased)
+			}
+			if err != nil {
+				t.Fatalf("rebased patch %v does not apply: %v", rebased, err)
+			}
+			var expected interface{}
+			mustUnmarshal(t, c.expected, &expected)
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("got %v, want %v", result, expected)
+			}
+		})
+	}
+}
+
+func mustUnmarshal(t *testing.T, s string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,29 +1,147 @@
 -- name: GetUser :one
-SELECT id, name, email, bio, roles FROM users WHERE id = ?;
+SELECT id, name, email, bio, version FROM users WHERE id = ?;
+
+-- name: GetUserByEmail :one
+SELECT id, name, email, bio, version FROM users WHERE email = ?;
+
+-- name: GetUserCredentials :one
+SELECT id, email, password_hash FROM users WHERE email = ?;
+
+-- name: GetUserPasswordHash :one
+SELECT password_hash FROM users WHERE id = ?;
+
+-- name: UpdateUserPassword :exec
+UPDATE users SET password_hash = ? WHERE id = ?;
 
 -- name: CreateUser :one
-INSERT INTO users (name, email, bio, roles, password_hash) VALUES (?, ?, ?, ?, ?) RETURNING id, name, email, bio, roles;
+INSERT INTO users (name, email, bio, password_hash) VALUES (?, ?, ?, ?) RETURNING id, name, email, bio;
 
--- name: UpdateUser :exec
-UPDATE users SET name = ?, email = ?, bio = ?, roles = ?  WHERE id = ?;
+-- name: UpdateUser :execrows
+UPDATE users SET name = ?, email = ?, bio = ?, version = version + 1 WHERE id = ? AND version = ?;
 
 -- name: ListUsers :many
-SELECT id, name, email, bio, roles from users;
+SELECT id, name, email, bio from users;
 
--- name: DeleteUser :exec
+-- name: DeleteUser :execrows
 DELETE FROM users WHERE id = ?;
 
 -- name: GetDocument :one
 SELECT data FROM document WHERE id = ?;
 
+-- name: GetDocumentWithVersion :one
+SELECT data, version FROM document WHERE id = ?;
+
 -- name: ListDocuments :many
-SELECT id, data FROM document;
+SELECT id, data, version FROM document;
 
 -- name: CreateDocument :one
 INSERT INTO document (data) VALUES (?) RETURNING id;
 
--- name: UpdateDocument :exec
-UPDATE document SET data = ? WHERE id = ?;
+-- name: CreateDocumentWithID :exec
+INSERT INTO document (id, data) VALUES (?, ?);
 
--- name: DeleteDocument :exec
+-- name: UpdateDocument :execrows
+UPDATE document SET data = ?, version = version + 1 WHERE id = ? AND version = ?;
+
+-- name: DeleteDocument :execrows
 DELETE FROM document WHERE id = ?;
+
+-- name: CreateDocumentRevision :one
+INSERT INTO document_revisions (document_id, version, data, patch, inverse) VALUES (?, ?, ?, ?, ?) RETURNING id;
+
+-- name: GetDocumentRevision :one
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE document_id = ? AND version = ?;
+
+-- name: ListDocumentRevisions :many
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE document_id = ? ORDER BY version;
+
+-- name: ListRevisionsSince :many
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE id > ? ORDER BY id;
+
+-- name: ListDocumentRevisionsSince :many
+SELECT id, document_id, version, data, patch, inverse, created_at FROM document_revisions WHERE document_id = ? AND id > ? ORDER BY id;
+
+-- name: CreateWebhook :one
+INSERT INTO webhooks (url, events, secret) VALUES (?, ?, ?) RETURNING id, url, events, secret, created_at;
+
+-- name: GetWebhook :one
+SELECT id, url, events, secret, created_at FROM webhooks WHERE id = ?;
+
+-- name: ListWebhooks :many
+SELECT id, url, events, secret, created_at FROM webhooks ORDER BY id;
+
+-- name: DeleteWebhook :execrows
+DELETE FROM webhooks WHERE id = ?;
+
+-- name: EnqueueWebhookDelivery :exec
+INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, attempt, state, next_attempt_at) VALUES (?, ?, ?, ?, 0, 'pending', CURRENT_TIMESTAMP);
+
+-- name: ListDueWebhookDeliveries :many
+SELECT d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.attempt, d.next_attempt_at, w.url, w.secret
+FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+WHERE d.state = 'pending' AND d.next_attempt_at <= ? ORDER BY d.id LIMIT ?;
+
+-- name: ClaimWebhookDelivery :execrows
+UPDATE webhook_deliveries SET next_attempt_at = sqlc.arg(lease_until)
+WHERE id = sqlc.arg(id) AND state = 'pending' AND next_attempt_at = sqlc.arg(due_at);
+
+-- name: UpdateWebhookDelivery :exec
+UPDATE webhook_deliveries SET attempt = ?, state = ?, status_code = ?, error = ?, next_attempt_at = ? WHERE id = ?;
+
+-- name: ListWebhookDeliveries :many
+SELECT id, webhook_id, event_id, event_type, payload, attempt, status_code, error, created_at, state, next_attempt_at FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?;
+
+-- name: DeleteWebhookDeliveries :exec
+DELETE FROM webhook_deliveries WHERE webhook_id = ?;
+
+-- name: CreateAuditEntry :exec
+INSERT INTO audit_log (actor, request_id, resource_type, resource_id, operation, patch) VALUES (?, ?, ?, ?, ?, ?);
+
+-- name: ListAuditLog :many
+SELECT id, actor, request_id, resource_type, resource_id, operation, patch, created_at FROM audit_log
+WHERE (sqlc.narg(resource_type) IS NULL OR resource_type = sqlc.narg(resource_type))
+  AND (sqlc.narg(resource_id) IS NULL OR resource_id = sqlc.narg(resource_id))
+  AND (sqlc.narg(actor) IS NULL OR actor = sqlc.narg(actor))
+  AND (sqlc.narg(since) IS NULL OR created_at >= sqlc.narg(since))
+  AND (sqlc.narg(until) IS NULL OR created_at < sqlc.narg(until))
+ORDER BY id DESC LIMIT sqlc.arg(limit);
+
+-- name: CreateRefreshToken :exec
+INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES (?, ?, ?);
+
+-- name: GetRefreshToken :one
+SELECT id, user_id, token_hash, expires_at, revoked_at, created_at FROM refresh_tokens WHERE token_hash = ?;
+
+-- name: RevokeRefreshToken :execrows
+UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE token_hash = ? AND revoked_at IS NULL;
+
+-- name: RevokeUserRefreshTokens :exec
+UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL;
+
+-- name: CreatePasswordReset :exec
+INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?);
+
+-- name: GetPasswordReset :one
+SELECT id, user_id, token_hash, expires_at, used_at, created_at FROM password_resets WHERE token_hash = ?;
+
+-- name: UsePasswordReset :execrows
+UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE token_hash = ? AND used_at IS NULL;
+
+-- name: InvalidatePasswordResets :exec
+UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL;
+
+-- name: CreateRole :exec
+INSERT INTO roles (name) VALUES (?) ON CONFLICT (name) DO NOTHING;
+
+-- name: AddUserRole :exec
+INSERT INTO user_roles (user_id, role_id, position)
+SELECT sqlc.arg(user_id), id, sqlc.arg(position) FROM roles WHERE name = sqlc.arg(name);
+
+-- name: ListUserRoles :many
+SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ? ORDER BY ur.position;
+
+-- name: ListRoleAssignments :many
+SELECT ur.user_id, r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id ORDER BY ur.user_id, ur.position;
+
+-- name: DeleteUserRoles :exec
+DELETE FROM user_roles WHERE user_id = ?;
@@ -0,0 +1,347 @@
+// Package webhook delivers document and user change events to the HTTP
+// endpoints subscribed to them.
+//
+// Each delivery is a POST of the JSON encoded Event. The body is signed with
+// the subscription's secret using HMAC-SHA256, and the hex digest is sent in
+// the X-Webhook-Signature header as "sha256=<digest>".
+//
+// Deliveries are queued in the webhook_deliveries table by Enqueue, in the
+// transaction that makes the change, and sent by a Dispatcher: once right
+// after the change commits, and again by a scheduled function for
+// deliveries that failed, with exponential backoff between attempts.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+)
+
+// Event types a subscription can ask for. A subscription may also list
+// "document.*", "user.*" or "*".
+const (
+	DocumentCreated = "document.created"
+	DocumentUpdated = "document.updated"
+	DocumentDeleted = "document.deleted"
+	UserCreated     = "user.created"
+	UserUpdated     = "user.updated"
+	UserDeleted     = "user.deleted"
+)
+
+// EventTypes lists every event type in the order they are documented.
+var EventTypes = []string{
+	DocumentCreated, DocumentUpdated, DocumentDeleted,
+	UserCreated, UserUpdated, UserDeleted,
+}
+
+// Event is the payload of a delivery.
+type Event struct {
+	// ID identifies the event across retries, so receivers can drop
+	// duplicates.
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	ResourceID int64           `json:"resourceId"`
+	Version    int64           `json:"version,omitempty"`
+	Patch      json.RawMessage `json:"patch,omitempty"`
+	Time       time.Time       `json:"time"`
+}
+
+// NewEvent returns an event of the given type with a fresh ID.
+func NewEvent(eventType string, resourceID, version int64, patch json.RawMessage) Event {
+	return Event{
+		ID:         newID(),
+		Type:       eventType,
+		ResourceID: resourceID,
+		Version:    version,
+		Patch:      patch,
+		Time:       time.Now().UTC(),
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidEventType reports whether a subscription may list t.
+func ValidEventType(t string) bool {
+	if t == "*" || t == "document.*" || t == "user.*" {
+		return true
+	}
+	for _, known := range EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether a subscription to the comma separated event types
+// in events receives eventType.
+func Matches(events, eventType string) bool {
+	for _, t := range strings.Split(events, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == eventType {
+			return true
+		}
+		if strings.HasSuffix(t, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the X-Webhook-Signature value for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is a valid signature of body.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Delivery states.
+const (
+	Pending   = "pending"
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// timestampLayout is how SQLite's CURRENT_TIMESTAMP formats times, used for
+// next_attempt_at so it compares with them.
+const timestampLayout = "2006-01-02 15:04:05"
+
+// Store is the part of the generated queries webhook delivery needs.
+type Store interface {
+	ListWebhooks(ctx context.Context) ([]data.Webhook, error)
+	EnqueueWebhookDelivery(ctx context.Context, arg data.EnqueueWebhookDeliveryParams) error
+	ListDueWebhookDeliveries(ctx context.Context, arg data.ListDueWebhookDeliveriesParams) ([]data.ListDueWebhookDeliveriesRow, error)
+	ClaimWebhookDelivery(ctx context.Context, arg data.ClaimWebhookDeliveryParams) (int64, error)
+	UpdateWebhookDelivery(ctx context.Context, arg data.UpdateWebhookDeliveryParams) error
+}
+
+// Enqueue queues a delivery of each event to every subscription that asked
+// for it. Pass the store of the transaction making the change, so that the
+// deliveries are queued exactly when the change commits; a Dispatcher sends
+// them afterwards.
+func Enqueue(ctx context.Context, store Store, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	hooks, err := store.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		var body []byte
+		for _, hook := range hooks {
+			if !Matches(hook.Events, ev.Type) {
+				continue
+			}
+			if body == nil {
+				if body, err = json.Marshal(ev); err != nil {
+					return err
+				}
+			}
+			err := store.EnqueueWebhookDelivery(ctx, data.EnqueueWebhookDeliveryParams{
+				WebhookID: hook.ID,
+				EventID:   ev.ID,
+				EventType: ev.Type,
+				Payload:   string(body),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Dispatcher sends queued deliveries.
+type Dispatcher struct {
+	Store  Store
+	Client *http.Client
+	// Attempts is how many times a delivery is tried before giving up.
+	Attempts int
+	// Backoff is the wait before the first retry; it doubles after each
+	// further failure.
+	Backoff time.Duration
+	// Lease is how long a delivery being sent is hidden from other
+	// dispatchers. It must be longer than the client timeout.
+	Lease time.Duration
+}
+
+// NewDispatcher returns a Dispatcher with a five second client timeout,
+// five attempts and a one minute initial backoff, suited to retries being
+// sent by a scheduled function.
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		Store:    store,
+		Client:   &http.Client{Timeout: 5 * time.Second},
+		Attempts: 5,
+		Backoff:  time.Minute,
+		Lease:    time.Minute,
+	}
+}
+
+// Send makes one attempt at up to limit deliveries that are due, oldest
+// first, and returns how many it attempted. Subscriptions are served
+// concurrently, each receiving its deliveries in the order they were
+// queued, though a delivery that is retried arrives after later ones.
+// Failed attempts are scheduled for a retry, or marked failed once they
+// run out of attempts. Send stops starting new attempts when ctx is done.
+func (d *Dispatcher) Send(ctx context.Context, limit int) (int, error) {
+	now := time.Now().UTC()
+	due, err := d.Store.ListDueWebhookDeliveries(ctx, data.ListDueWebhookDeliveriesParams{
+		NextAttemptAt: timestamp(now),
+		Limit:         int64(limit),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var order []int64
+	byHook := make(map[int64][]data.ListDueWebhookDeliveriesRow)
+	for _, dl := range due {
+		if _, ok := byHook[dl.WebhookID]; !ok {
+			order = append(order, dl.WebhookID)
+		}
+		byHook[dl.WebhookID] = append(byHook[dl.WebhookID], dl)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		attempted int
+	)
+	for _, hookID := range order {
+		wg.Add(1)
+		go func(deliveries []data.ListDueWebhookDeliveriesRow) {
+			defer wg.Done()
+			for _, dl := range deliveries {
+				if ctx.Err() != nil {
+					return
+				}
+				if d.attempt(ctx, dl, now) {
+					mu.Lock()
+					attempted++
+					mu.Unlock()
+				}
+			}
+		}(byHook[hookID])
+	}
+	wg.Wait()
+	return attempted, nil
+}
+
+// afterCommitTimeout bounds how long SendAfterCommit holds up the write that
+// queued the deliveries, so a slow receiver cannot delay its response.
+// Whatever is not sent in time is retried by the scheduled function.
+var afterCommitTimeout = 2 * time.Second
+
+// afterCommitLimit is how many deliveries SendAfterCommit attempts.
+const afterCommitLimit = 100
+
+// SendAfterCommit makes the first attempt at the deliveries a write queued,
+// once its transaction has committed. It gives up after a short timeout and
+// logs rather than returns errors, since the write has already succeeded.
+func (d *Dispatcher) SendAfterCommit(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, afterCommitTimeout)
+	defer cancel()
+	if _, err := d.Send(ctx, afterCommitLimit); err != nil {
+		log.Printf("sending webhooks: %v", err)
+	}
+}
+
+// attempt claims dl and sends it once, recording the outcome. It reports
+// false when another dispatcher claimed dl first.
+func (d *Dispatcher) attempt(ctx context.Context, dl data.ListDueWebhookDeliveriesRow, now time.Time) bool {
+	claimed, err := d.Store.ClaimWebhookDelivery(ctx, data.ClaimWebhookDeliveryParams{
+		LeaseUntil: timestamp(now.Add(d.Lease)),
+		ID:         dl.ID,
+		DueAt:      dl.NextAttemptAt,
+	})
+	if err != nil {
+		log.Printf("webhook %d: claiming delivery %d: %v", dl.WebhookID, dl.ID, err)
+		return false
+	}
+	if claimed == 0 {
+		return false
+	}
+
+	status, err := d.post(ctx, dl)
+	update := data.UpdateWebhookDeliveryParams{
+		ID:      dl.ID,
+		Attempt: dl.Attempt + 1,
+		State:   Pending,
+	}
+	if err != nil {
+		update.Error = sql.NullString{String: err.Error(), Valid: true}
+	} else {
+		update.StatusCode = sql.NullInt64{Int64: int64(status), Valid: true}
+	}
+	switch {
+	case err == nil && status < 300:
+		update.State = Delivered
+	case err == nil && status < 500 && status != http.StatusTooManyRequests:
+		log.Printf("webhook %d: %s rejected with status %d", dl.WebhookID, dl.EventType, status)
+		update.State = Failed
+	case update.Attempt >= int64(d.Attempts):
+		log.Printf("webhook %d: giving up on %s %s after %d attempts", dl.WebhookID, dl.EventType, dl.EventID, update.Attempt)
+		update.State = Failed
+	default:
+		wait := d.Backoff << (update.Attempt - 1)
+		update.NextAttemptAt = timestamp(time.Now().UTC().Add(wait))
+	}
+
+	// Record the attempt even when ctx ran out during it.
+	if err := d.Store.UpdateWebhookDelivery(context.WithoutCancel(ctx), update); err != nil {
+		log.Printf("webhook %d: recording delivery %d: %v", dl.WebhookID, dl.ID, err)
+	}
+	return true
+}
+
+func (d *Dispatcher) post(ctx context.Context, dl data.ListDueWebhookDeliveriesRow) (int, error) {
+	body := []byte(dl.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dummy-json-patch-webhook")
+	req.Header.Set("X-Webhook-Event", dl.EventType)
+	req.Header.Set("X-Webhook-Delivery", dl.EventID)
+	req.Header.Set("X-Webhook-Signature", Sign(dl.Secret, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+func timestamp(t time.Time) sql.NullString {
+	return sql.NullString{String: t.UTC().Format(timestampLayout), Valid: true}
+}
@@ -0,0 +1,245 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	data "github.com/mr-destructive/dummy-json-patch/dummyuser"
+)
+
+type memoryStore struct {
+	mu         sync.Mutex
+	hooks      []data.Webhook
+	deliveries []data.WebhookDelivery
+}
+
+func (s *memoryStore) ListWebhooks(ctx context.Context) ([]data.Webhook, error) {
+	return s.hooks, nil
+}
+
+func (s *memoryStore) EnqueueWebhookDelivery(ctx context.Context, arg data.EnqueueWebhookDeliveryParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = append(s.deliveries, data.WebhookDelivery{
+		ID:            int64(len(s.deliveries) + 1),
+		WebhookID:     arg.WebhookID,
+		EventID:       arg.EventID,
+		EventType:     arg.EventType,
+		Payload:       arg.Payload,
+		State:         Pending,
+		NextAttemptAt: timestamp(time.Now()),
+	})
+	return nil
+}
+
+func (s *memoryStore) ListDueWebhookDeliveries(ctx context.Context, arg data.ListDueWebhookDeliveriesParams) ([]data.ListDueWebhookDeliveriesRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []data.ListDueWebhookDeliveriesRow
+	for _, d := range s.deliveries {
+		if d.State != Pending || d.NextAttemptAt.String > arg.NextAttemptAt.String {
+			continue
+		}
+		hook := s.hooks[d.WebhookID-1]
+		due = append(due, data.ListDueWebhookDeliveriesRow{
+			ID: d.ID, WebhookID: d.WebhookID, EventID: d.EventID, EventType: d.EventType,
+			Payload: d.Payload, Attempt: d.Attempt, NextAttemptAt: d.NextAttemptAt,
+			Url: hook.Url, Secret: hook.Secret,
+		})
+	}
+	return due, nil
+}
+
+func (s *memoryStore) ClaimWebhookDelivery(ctx context.Context, arg data.ClaimWebhookDeliveryParams) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := &s.deliveries[arg.ID-1]
+	if d.State != Pending || d.NextAttemptAt != arg.DueAt {
+		return 0, nil
+	}
+	d.NextAttemptAt = arg.LeaseUntil
+	return 1, nil
+}
+
+func (s *memoryStore) UpdateWebhookDelivery(ctx context.Context, arg data.UpdateWebhookDeliveryParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := &s.deliveries[arg.ID-1]
+	d.Attempt, d.State, d.StatusCode, d.Error, d.NextAttemptAt = arg.Attempt, arg.State, arg.StatusCode, arg.Error, arg.NextAttemptAt
+	return nil
+}
+
+func TestSend(t *testing.T) {
+	const secret = "s3cret"
+	var (
+		mu       sync.Mutex
+		requests int
+		received []Event
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			// Fail the first attempt to exercise the retry.
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(secret, body, r.Header.Get("X-Webhook-Signature")) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Webhook-Signature"))
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Webhook-Event") != ev.Type {
+			t.Errorf("X-Webhook-Event %q for a %s event", r.Header.Get("X-Webhook-Event"), ev.Type)
+		}
+		received = append(received, ev)
+	}))
+	defer receiver.Close()
+
+	store := &memoryStore{hooks: []data.Webhook{
+		{ID: 1, Url: receiver.URL, Events: "document.*", Secret: secret},
+		{ID: 2, Url: receiver.URL, Events: UserDeleted, Secret: secret},
+	}}
+	ctx := context.Background()
+
+	patch := json.RawMessage(`[{"op":"replace","path":"/a","value":1}]`)
+	err := Enqueue(ctx, store, []Event{
+		NewEvent(DocumentUpdated, 7, 2, patch),
+		NewEvent(UserUpdated, 3, 4, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.deliveries) != 1 {
+		t.Fatalf("queued %d deliveries, want 1", len(store.deliveries))
+	}
+
+	d := NewDispatcher(store)
+	d.Backoff = 0
+	if n, err := d.Send(ctx, 10); err != nil || n != 1 {
+		t.Fatalf("first Send attempted %d, %v", n, err)
+	}
+	if first := store.deliveries[0]; first.State != Pending || first.Attempt != 1 || first.StatusCode.Int64 != http.StatusServiceUnavailable {
+		t.Errorf("after the first attempt the delivery is %+v", first)
+	}
+	if n, err := d.Send(ctx, 10); err != nil || n != 1 {
+		t.Fatalf("second Send attempted %d, %v", n, err)
+	}
+	if second := store.deliveries[0]; second.State != Delivered || second.Attempt != 2 || second.StatusCode.Int64 != http.StatusOK {
+		t.Errorf("after the second attempt the delivery is %+v", second)
+	}
+	if n, _ := d.Send(ctx, 10); n != 0 {
+		t.Errorf("third Send attempted %d delivered deliveries", n)
+	}
+
+	if len(received) != 1 {
+		t.Fatalf("received %d events, want 1", len(received))
+	}
+	if ev := received[0]; ev.Type != DocumentUpdated || ev.ResourceID != 7 || string(ev.Patch) != string(patch) {
+		t.Errorf("received %+v", ev)
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer receiver.Close()
+
+	store := &memoryStore{hooks: []data.Webhook{{ID: 1, Url: receiver.URL, Events: "*", Secret: "s"}}}
+	ctx := context.Background()
+	if err := Enqueue(ctx, store, []Event{NewEvent(UserDeleted, 1, 0, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(store)
+	d.Attempts = 2
+	d.Backoff = 0
+	d.Send(ctx, 10)
+	d.Send(ctx, 10)
+	if dl := store.deliveries[0]; dl.State != Failed || dl.Attempt != 2 || dl.NextAttemptAt.Valid {
+		t.Errorf("after running out of attempts the delivery is %+v", dl)
+	}
+}
+
+func TestSendAfterCommit(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Header.Get("X-Webhook-Event"))
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	store := &memoryStore{hooks: []data.Webhook{
+		{ID: 1, Url: receiver.URL, Events: DocumentCreated, Secret: "s"},
+		{ID: 2, Url: receiver.URL + "/slow", Events: DocumentDeleted, Secret: "s"},
+	}}
+	ctx := context.Background()
+	err := Enqueue(ctx, store, []Event{
+		NewEvent(DocumentCreated, 1, 1, nil),
+		NewEvent(DocumentDeleted, 2, 3, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(timeout time.Duration) { afterCommitTimeout = timeout }(afterCommitTimeout)
+	afterCommitTimeout = 50 * time.Millisecond
+	d := NewDispatcher(store)
+	d.Backoff = time.Hour
+	start := time.Now()
+	d.SendAfterCommit(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SendAfterCommit waited %v for a slow receiver", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("receiver saw %v, want both events", got)
+	}
+	if dl := store.deliveries[0]; dl.State != Delivered {
+		t.Errorf("the fast delivery is %+v", dl)
+	}
+	if dl := store.deliveries[1]; dl.State != Pending || !dl.NextAttemptAt.Valid {
+		t.Errorf("the timed out delivery is %+v, want it left for a retry", dl)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		events, eventType string
+		want              bool
+	}{
+		{"*", UserCreated, true},
+		{"document.*", DocumentDeleted, true},
+		{"document.*", UserDeleted, false},
+		{"user.created, user.deleted", UserDeleted, true},
+		{"user.created", UserUpdated, false},
+	}
+	for _, c := range cases {
+		if got := Matches(c.events, c.eventType); got != c.want {
+			t.Errorf("Matches(%q, %q) = %v, want %v", c.events, c.eventType, got, c.want)
+		}
+	}
+}